@@ -60,6 +60,46 @@ in
                   File used as the template. When this value is specified, `sops.templates.<name>.content` is ignored.
                 '';
               };
+              engine = mkOption {
+                type = types.enum [
+                  "placeholder"
+                  "go-template"
+                ];
+                default = "placeholder";
+                description = ''
+                  How the template is rendered.
+                  `placeholder` replaces `config.sops.placeholder.<name>` with the secret.
+                  `go-template` renders the template with Go's text/template, secrets are inserted
+                  with `{{ secret "<name>" }}` and can be piped to `b64enc`, `json`, `shellQuote`,
+                  `urlquery`, `indent <n>` and `sha256`.
+                '';
+              };
+              restartUnits = mkOption {
+                type = types.listOf types.str;
+                default = [ ];
+                example = [ "syncthing.service" ];
+                description = ''
+                  Names of user units that should be restarted when the rendered file changes.
+                  Units are only restarted by `sops.watch`.
+                '';
+              };
+              reloadUnits = mkOption {
+                type = types.listOf types.str;
+                default = [ ];
+                example = [ "syncthing.service" ];
+                description = ''
+                  Names of user units that should be reloaded when the rendered file changes.
+                  Units are only reloaded by `sops.watch`.
+                '';
+              };
+              onChange = mkOption {
+                type = types.nullOr types.str;
+                default = null;
+                description = ''
+                  Shell command that is run with `/bin/sh` when the rendered template is added or changed,
+                  like the `onChange` option of secrets. It is only run by `sops.watch`.
+                '';
+              };
             };
           }
         )
@@ -82,6 +122,7 @@ in
 
   config = lib.optionalAttrs (options ? sops.secrets) (
     lib.mkIf (hmConfig.sops.templates != { }) {
+      # Keep this in sync with `placeholderPattern` in `pkgs/sops-install-secrets/templates.go`
       sops.placeholder = mapAttrs (
         name: _: mkDefault "<SOPS:${builtins.hashString "sha256" name}:PLACEHOLDER>"
       ) hmConfig.sops.secrets;
@@ -49,11 +49,14 @@ let
         };
         key = lib.mkOption {
           type = lib.types.str;
-          default = config._module.args.name;
+          default = if lib.elem config.format [ "dotenv" "ini" ] then "" else config._module.args.name;
+          defaultText = lib.literalMD "`\"\"` for dotenv and ini, otherwise the name of the secret";
           description = ''
             Key used to lookup in the sops file.
-            No tested data structures are supported right now.
-            This option is ignored if format is binary.
+            To access nested data structures, use / as a separator.
+            List elements are selected with `list[0]`, keys containing / with `["a/b"]` or `a\/b`.
+            This option is ignored if format is binary, age or pgp.
+            For dotenv files this is the variable name, for ini files `section/key`.
           '';
         };
         path = lib.mkOption {
@@ -76,11 +79,210 @@ let
             "binary"
             "dotenv"
             "ini"
+            "age"
+            "pgp"
           ];
           default = cfg.defaultSopsFormat;
           description = ''
             File format used to decrypt the sops secret.
             Binary files are written to the target file as is.
+            age and pgp files are not wrapped by sops, they are decrypted as a whole
+            with the configured age or GPG keys.
+          '';
+        };
+        valueFormat = lib.mkOption {
+          type = lib.types.nullOr (
+            lib.types.enum [
+              "yaml"
+              "json"
+            ]
+          );
+          default = null;
+          description = ''
+            Format used to write the value if `key` selects a map or a list in a yaml or json file.
+            Defaults to the format of the sops file. Numbers and booleans are written as text.
+          '';
+        };
+        transforms = lib.mkOption {
+          type = lib.types.listOf (
+            lib.types.enum [
+              "base64-decode"
+              "base64-encode"
+              "hex-decode"
+              "hex-encode"
+              "trim"
+              "trailing-newline"
+              "gunzip"
+            ]
+          );
+          default = [ ];
+          example = [
+            "trim"
+            "base64-decode"
+          ];
+          description = ''
+            Steps applied in order to the decrypted value before it is written.
+            `"trim"` removes leading and trailing whitespace and `"trailing-newline"` appends a newline unless there is one.
+          '';
+        };
+        required = lib.mkOption {
+          type = lib.types.bool;
+          default = false;
+          description = ''
+            Abort the activation if this secret cannot be decrypted,
+            even if `sops.decryptionFailurePolicy` is `"keep-previous"`.
+          '';
+        };
+        generate = lib.mkOption {
+          type = lib.types.nullOr (
+            lib.types.submodule {
+              options = {
+                type = lib.mkOption {
+                  type = lib.types.enum [
+                    "password"
+                    "hex"
+                    "base64"
+                    "ed25519"
+                    "ssh-ed25519"
+                    "wireguard"
+                    "age"
+                  ];
+                  description = ''
+                    What to generate. `"hex"` and `"base64"` encode random bytes.
+                    `"ed25519"` creates a PEM encoded key, `"ssh-ed25519"` an OpenSSH key,
+                    `"wireguard"` a key as printed by `wg genkey` and `"age"` an age identity.
+                  '';
+                };
+                length = lib.mkOption {
+                  type = lib.types.nullOr lib.types.ints.positive;
+                  default = null;
+                  description = ''
+                    Number of characters of passwords and number of random bytes of `"hex"` and `"base64"` values.
+                    Defaults to 32.
+                  '';
+                };
+                charset = lib.mkOption {
+                  type = lib.types.nullOr lib.types.str;
+                  default = null;
+                  example = "abcdefghijklmnopqrstuvwxyz0123456789-_";
+                  description = "Characters of generated passwords. Defaults to letters and digits.";
+                };
+                publicKey = lib.mkOption {
+                  type = lib.types.nullOr lib.types.str;
+                  default = null;
+                  example = "wireguard/public";
+                  description = "Key in the same sops file that receives the public key of generated keypairs.";
+                };
+              };
+            }
+          );
+          default = null;
+          example = {
+            type = "password";
+            length = 24;
+          };
+          description = ''
+            Create the value of this secret with `sops-install-secrets generate` if its key is missing from the sops file.
+            The generated value is added to the sops file, which is then re-encrypted to the recipients in `.sops.yaml`.
+          '';
+        };
+        hashes = lib.mkOption {
+          type = lib.types.attrsOf (
+            lib.types.submodule (
+              { name, ... }@hash:
+              {
+                options = {
+                  name = lib.mkOption {
+                    type = lib.types.str;
+                    default = "${config.name}.${name}";
+                    defaultText = "$secret.$name";
+                    description = ''
+                      Name of the file with the hash, next to the secret.
+                    '';
+                  };
+                  algorithm = lib.mkOption {
+                    type = lib.types.enum [
+                      "sha512-crypt"
+                      "yescrypt"
+                      "bcrypt"
+                      "argon2id"
+                      "htpasswd"
+                    ];
+                    description = ''
+                      Hash function. `"sha512-crypt"` and `"yescrypt"` create crypt(3) hashes as used in /etc/shadow,
+                      `"argon2id"` creates a hash in the PHC string format
+                      and `"htpasswd"` a line of a htpasswd file with a bcrypt hash, for the user set in `user`.
+                    '';
+                  };
+                  user = lib.mkOption {
+                    type = lib.types.nullOr lib.types.str;
+                    default = null;
+                    description = ''
+                      User name of the htpasswd line.
+                    '';
+                  };
+                  path = lib.mkOption {
+                    type = lib.types.str;
+                    default =
+                      if config.neededForUsers then
+                        "/run/secrets-for-users/${hash.config.name}"
+                      else
+                        "/run/secrets/${hash.config.name}";
+                    defaultText = "/run/secrets-for-users/$name when neededForUsers is set, /run/secrets/$name when otherwise.";
+                    description = ''
+                      Path where the hash is symlinked to.
+                      If the default is kept no symlink is created.
+                    '';
+                  };
+                  mode = lib.mkOption {
+                    type = lib.types.str;
+                    default = "0400";
+                    description = ''
+                      Permissions mode of the hash in octal.
+                    '';
+                  };
+                  owner = lib.mkOption {
+                    type = with lib.types; nullOr str;
+                    default = "root";
+                    description = ''
+                      User of the file. Can only be set if uid is 0.
+                    '';
+                  };
+                  uid = lib.mkOption {
+                    type = with lib.types; nullOr int;
+                    default = 0;
+                    description = ''
+                      UID of the file, only applied when owner is null.
+                    '';
+                  };
+                  group = lib.mkOption {
+                    type = with lib.types; nullOr str;
+                    default = "staff";
+                    defaultText = "staff";
+                    description = ''
+                      Group of the file. Can only be set if gid is 0.
+                    '';
+                  };
+                  gid = lib.mkOption {
+                    type = with lib.types; nullOr int;
+                    default = 0;
+                    description = ''
+                      GID of the file, only applied when group is null.
+                    '';
+                  };
+                };
+              }
+            )
+          );
+          default = { };
+          example = lib.literalExpression ''
+            {
+              shadow.algorithm = "yescrypt";
+            }
+          '';
+          description = ''
+            Files with hashes of the value of this secret, for example for `users.users.<name>.hashedPasswordFile`.
+            A hash is only replaced if the value changes, so units that use it are not restarted by a new salt.
           '';
         };
         mode = lib.mkOption {
@@ -222,7 +424,78 @@ in
       type = lib.types.ints.unsigned;
       default = 1;
       description = ''
-        Number of secrets generations to keep. Setting this to 0 disables pruning.
+        Number of secrets generations to keep. Setting this to 0 disables pruning by count.
+        Generations younger than `maxGenerationAge` are kept in addition.
+      '';
+    };
+
+    maxGenerationAge = lib.mkOption {
+      type = lib.types.nullOr lib.types.str;
+      default = null;
+      example = "24h";
+      description = ''
+        Keep all secrets generations younger than this duration, for example `"36h"` or `"90m"`,
+        even beyond `keepGenerations`. Older generations are pruned once they exceed `keepGenerations`.
+        The current generation is never pruned.
+        To retain generations by age only, set `keepGenerations` to 0.
+      '';
+    };
+
+    maxGenerationsBytes = lib.mkOption {
+      type = lib.types.ints.unsigned;
+      default = 0;
+      description = ''
+        Prune the oldest secrets generations until all generations together use at most this many bytes.
+        The current generation is never pruned. Setting this to 0 disables pruning by size.
+      '';
+    };
+
+    maxSopsFileAge = lib.mkOption {
+      type = lib.types.nullOr lib.types.str;
+      default = null;
+      example = "2160h";
+      description = ''
+        Maximum time since a sops file was last rotated, for example `"2160h"` for 90 days.
+        The file counts as rotated at the oldest of its `lastmodified` date and the `created_at` dates of its master keys
+        in its sops metadata. Editing a file only resets `lastmodified`. `created_at` is reset when a master key is added
+        to the file again, for example with `sops rotate --rm-pgp` followed by `sops rotate --add-pgp`.
+        age keys have no `created_at` date.
+        Older files are reported when the sops files are validated at build time and during activation.
+        Files in the `age` and `pgp` formats have no sops metadata and are not checked.
+      '';
+    };
+
+    expiredSopsFiles = lib.mkOption {
+      type = lib.types.enum [
+        "warn"
+        "error"
+      ];
+      default = "warn";
+      description = ''
+        Whether a sops file that is older than `maxSopsFileAge` is reported as a warning or fails the build and activation.
+      '';
+    };
+
+    decryptionWorkers = lib.mkOption {
+      type = lib.types.ints.unsigned;
+      default = 0;
+      description = ''
+        Maximum number of sops files decrypted in parallel.
+        Setting this to 0 uses the number of available CPUs.
+      '';
+    };
+
+    decryptionFailurePolicy = lib.mkOption {
+      type = lib.types.enum [
+        "abort"
+        "keep-previous"
+      ];
+      default = "abort";
+      description = ''
+        What to do if a secret cannot be decrypted.
+        With `"abort"`, no secrets are installed and the activation fails.
+        With `"keep-previous"`, secrets that are not `required` keep the file of the previous generation
+        and a warning is logged. If there is no previous generation, for example at boot, the secret is not installed.
       '';
     };
 
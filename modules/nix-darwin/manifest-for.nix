@@ -12,6 +12,12 @@ writeTextFile {
       secretsMountPoint = "/run/secrets.d";
       symlinkPath = "/run/secrets";
       keepGenerations = cfg.keepGenerations;
+      maxGenerationAge = cfg.maxGenerationAge;
+      maxGenerationsBytes = cfg.maxGenerationsBytes;
+      maxSopsFileAge = cfg.maxSopsFileAge;
+      expiredSopsFiles = cfg.expiredSopsFiles;
+      decryptionWorkers = cfg.decryptionWorkers;
+      decryptionFailurePolicy = cfg.decryptionFailurePolicy;
       gnupgHome = cfg.gnupg.home;
       sshKeyPaths = cfg.gnupg.sshKeyPaths;
       ageKeyFile = cfg.age.keyFile;
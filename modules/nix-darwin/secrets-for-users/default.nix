@@ -31,9 +31,12 @@ in
     {
       assertion =
         (lib.filterAttrs (
-          _: v: (v.uid != 0 && v.owner != "root") || (v.gid != 0 && v.group != "root")
+          _: v:
+          lib.any (f: (f.uid != 0 && f.owner != "root") || (f.gid != 0 && f.group != "root")) (
+            [ v ] ++ builtins.attrValues v.hashes
+          )
         ) secretsForUsers) == { };
-      message = "neededForUsers cannot be used for secrets that are not root-owned";
+      message = "neededForUsers cannot be used for secrets or hashes that are not root-owned";
     }
   ];
 
@@ -86,6 +86,20 @@ in
                   File used as the template. When this value is specified, `sops.templates.<name>.content` is ignored.
                 '';
               };
+              engine = mkOption {
+                type = types.enum [
+                  "placeholder"
+                  "go-template"
+                ];
+                default = "placeholder";
+                description = ''
+                  How the template is rendered.
+                  `placeholder` replaces `config.sops.placeholder.<name>` with the secret.
+                  `go-template` renders the template with Go's text/template, secrets are inserted
+                  with `{{ secret "<name>" }}` and can be piped to `b64enc`, `json`, `shellQuote`,
+                  `urlquery`, `indent <n>` and `sha256`.
+                '';
+              };
             };
           }
         )
@@ -108,6 +122,7 @@ in
 
   config = lib.optionalAttrs (options ? sops.secrets) (
     lib.mkIf (config.sops.templates != { }) {
+      # Keep this in sync with `placeholderPattern` in `pkgs/sops-install-secrets/templates.go`
       sops.placeholder = mapAttrs (
         name: _: mkDefault "<SOPS:${builtins.hashString "sha256" name}:PLACEHOLDER>"
       ) config.sops.secrets;
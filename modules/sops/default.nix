@@ -14,7 +14,11 @@ let
     inherit cfg;
     inherit (pkgs) writeTextFile;
   };
-  manifest = manifestFor "" regularSecrets regularTemplates { };
+  manifest = manifestFor "" regularSecrets regularTemplates {
+    # Used to validate restartUnits and reloadUnits
+    systemdUnits = builtins.attrNames config.systemd.units;
+  };
+  outputFlag = lib.optionalString (cfg.outputFormat != "text") "-output=${cfg.outputFormat} ";
 
   pathNotInStore = lib.mkOptionType {
     name = "pathNotInStore";
@@ -26,6 +30,8 @@ let
 
   regularSecrets = lib.filterAttrs (_: v: !v.neededForUsers) cfg.secrets;
 
+  brokerSecrets = lib.filterAttrs (_: v: v.delivery == "broker") regularSecrets;
+
   # Currently, all templates are "regular" (there's no support for `neededForUsers` for templates.)
   regularTemplates = cfg.templates;
 
@@ -62,11 +68,20 @@ let
         };
         key = lib.mkOption {
           type = lib.types.str;
-          default = if cfg.defaultSopsKey != null then cfg.defaultSopsKey else config._module.args.name;
+          default =
+            if lib.elem config.format [ "dotenv" "ini" ] then
+              ""
+            else if cfg.defaultSopsKey != null then
+              cfg.defaultSopsKey
+            else
+              config._module.args.name;
+          defaultText = lib.literalMD "`\"\"` for dotenv and ini, otherwise `sops.defaultSopsKey` or the name of the secret";
           description = ''
             Key used to lookup in the sops file.
-            No tested data structures are supported right now.
-            This option is ignored if format is binary.
+            To access nested data structures, use / as a separator.
+            List elements are selected with `list[0]`, keys containing / with `["a/b"]` or `a\/b`.
+            This option is ignored if format is binary, age or pgp.
+            For dotenv files this is the variable name, for ini files `section/key`.
             "" means whole file.
           '';
         };
@@ -90,11 +105,210 @@ let
             "binary"
             "dotenv"
             "ini"
+            "age"
+            "pgp"
           ];
           default = cfg.defaultSopsFormat;
           description = ''
             File format used to decrypt the sops secret.
             Binary files are written to the target file as is.
+            age and pgp files are not wrapped by sops, they are decrypted as a whole
+            with the configured age or GPG keys.
+          '';
+        };
+        valueFormat = lib.mkOption {
+          type = lib.types.nullOr (
+            lib.types.enum [
+              "yaml"
+              "json"
+            ]
+          );
+          default = null;
+          description = ''
+            Format used to write the value if `key` selects a map or a list in a yaml or json file.
+            Defaults to the format of the sops file. Numbers and booleans are written as text.
+          '';
+        };
+        transforms = lib.mkOption {
+          type = lib.types.listOf (
+            lib.types.enum [
+              "base64-decode"
+              "base64-encode"
+              "hex-decode"
+              "hex-encode"
+              "trim"
+              "trailing-newline"
+              "gunzip"
+            ]
+          );
+          default = [ ];
+          example = [
+            "trim"
+            "base64-decode"
+          ];
+          description = ''
+            Steps applied in order to the decrypted value before it is written.
+            `"trim"` removes leading and trailing whitespace and `"trailing-newline"` appends a newline unless there is one.
+          '';
+        };
+        required = lib.mkOption {
+          type = lib.types.bool;
+          default = false;
+          description = ''
+            Abort the activation if this secret cannot be decrypted,
+            even if `sops.decryptionFailurePolicy` is `"keep-previous"`.
+          '';
+        };
+        generate = lib.mkOption {
+          type = lib.types.nullOr (
+            lib.types.submodule {
+              options = {
+                type = lib.mkOption {
+                  type = lib.types.enum [
+                    "password"
+                    "hex"
+                    "base64"
+                    "ed25519"
+                    "ssh-ed25519"
+                    "wireguard"
+                    "age"
+                  ];
+                  description = ''
+                    What to generate. `"hex"` and `"base64"` encode random bytes.
+                    `"ed25519"` creates a PEM encoded key, `"ssh-ed25519"` an OpenSSH key,
+                    `"wireguard"` a key as printed by `wg genkey` and `"age"` an age identity.
+                  '';
+                };
+                length = lib.mkOption {
+                  type = lib.types.nullOr lib.types.ints.positive;
+                  default = null;
+                  description = ''
+                    Number of characters of passwords and number of random bytes of `"hex"` and `"base64"` values.
+                    Defaults to 32.
+                  '';
+                };
+                charset = lib.mkOption {
+                  type = lib.types.nullOr lib.types.str;
+                  default = null;
+                  example = "abcdefghijklmnopqrstuvwxyz0123456789-_";
+                  description = "Characters of generated passwords. Defaults to letters and digits.";
+                };
+                publicKey = lib.mkOption {
+                  type = lib.types.nullOr lib.types.str;
+                  default = null;
+                  example = "wireguard/public";
+                  description = "Key in the same sops file that receives the public key of generated keypairs.";
+                };
+              };
+            }
+          );
+          default = null;
+          example = {
+            type = "password";
+            length = 24;
+          };
+          description = ''
+            Create the value of this secret with `sops-install-secrets generate` if its key is missing from the sops file.
+            The generated value is added to the sops file, which is then re-encrypted to the recipients in `.sops.yaml`.
+          '';
+        };
+        hashes = lib.mkOption {
+          type = lib.types.attrsOf (
+            lib.types.submodule (
+              { name, ... }@hash:
+              {
+                options = {
+                  name = lib.mkOption {
+                    type = lib.types.str;
+                    default = "${config.name}.${name}";
+                    defaultText = "$secret.$name";
+                    description = ''
+                      Name of the file with the hash, next to the secret.
+                    '';
+                  };
+                  algorithm = lib.mkOption {
+                    type = lib.types.enum [
+                      "sha512-crypt"
+                      "yescrypt"
+                      "bcrypt"
+                      "argon2id"
+                      "htpasswd"
+                    ];
+                    description = ''
+                      Hash function. `"sha512-crypt"` and `"yescrypt"` create crypt(3) hashes as used in /etc/shadow,
+                      `"argon2id"` creates a hash in the PHC string format
+                      and `"htpasswd"` a line of a htpasswd file with a bcrypt hash, for the user set in `user`.
+                    '';
+                  };
+                  user = lib.mkOption {
+                    type = lib.types.nullOr lib.types.str;
+                    default = null;
+                    description = ''
+                      User name of the htpasswd line.
+                    '';
+                  };
+                  path = lib.mkOption {
+                    type = lib.types.str;
+                    default =
+                      if config.neededForUsers then
+                        "/run/secrets-for-users/${hash.config.name}"
+                      else
+                        "/run/secrets/${hash.config.name}";
+                    defaultText = "/run/secrets-for-users/$name when neededForUsers is set, /run/secrets/$name when otherwise.";
+                    description = ''
+                      Path where the hash is symlinked to.
+                      If the default is kept no symlink is created.
+                    '';
+                  };
+                  mode = lib.mkOption {
+                    type = lib.types.str;
+                    default = "0400";
+                    description = ''
+                      Permissions mode of the hash in octal.
+                    '';
+                  };
+                  owner = lib.mkOption {
+                    type = with lib.types; nullOr str;
+                    default = null;
+                    description = ''
+                      User of the file. Can only be set if uid is 0.
+                    '';
+                  };
+                  uid = lib.mkOption {
+                    type = with lib.types; nullOr int;
+                    default = 0;
+                    description = ''
+                      UID of the file, only applied when owner is null.
+                    '';
+                  };
+                  group = lib.mkOption {
+                    type = with lib.types; nullOr str;
+                    default = if hash.config.owner != null then users.${hash.config.owner}.group else null;
+                    defaultText = lib.literalMD "{option}`config.users.users.\${owner}.group`";
+                    description = ''
+                      Group of the file. Can only be set if gid is 0.
+                    '';
+                  };
+                  gid = lib.mkOption {
+                    type = with lib.types; nullOr int;
+                    default = 0;
+                    description = ''
+                      GID of the file, only applied when group is null.
+                    '';
+                  };
+                };
+              }
+            )
+          );
+          default = { };
+          example = lib.literalExpression ''
+            {
+              shadow.algorithm = "yescrypt";
+            }
+          '';
+          description = ''
+            Files with hashes of the value of this secret, for example for `users.users.<name>.hashedPasswordFile`.
+            A hash is only replaced if the value changes, so units that use it are not restarted by a new salt.
           '';
         };
         mode = lib.mkOption {
@@ -165,6 +379,43 @@ let
             This works the same way as <xref linkend="opt-systemd.services._name_.reloadTriggers" />.
           '';
         };
+        onChange = lib.mkOption {
+          type = lib.types.nullOr lib.types.str;
+          default = null;
+          example = "docker exec nginx nginx -s reload";
+          description = ''
+            Shell command that is run with `/bin/sh` when this secret is added or changed, after `/run/secrets` points to the new secret.
+            `SOPS_NIX_NAME`, `SOPS_NIX_PATH` and `SOPS_NIX_CHANGE` (`added` or `modified`) are set in its environment.
+            It is not run when the system boots.
+          '';
+        };
+        delivery = lib.mkOption {
+          type = lib.types.enum [
+            "file"
+            "keyring"
+            "broker"
+          ];
+          default = "file";
+          description = ''
+            How the secret is delivered. With `"keyring"`, the secret is not written to any file.
+            Instead, it is loaded into the kernel keyring as a `user` key with the description `sops-nix:<name>`,
+            owned by `owner` and `group` and readable according to `mode`.
+            Users other than root read it by the id listed in `/proc/keys`, see the README.
+            With `"broker"`, the secret is only kept in the memory of `sops-secret-broker.service`
+            and fetched with `sops-install-secrets get <name>` by processes that may read it according to
+            `owner`, `group` and `mode`, or that belong to one of the `brokerUnits`.
+            `path` has no effect for such secrets, and they are not restored by `sops-install-secrets rollback`.
+          '';
+        };
+        brokerUnits = lib.mkOption {
+          type = lib.types.listOf lib.types.str;
+          default = [ ];
+          example = [ "nginx.service" ];
+          description = ''
+            Units whose processes may fetch this secret from the broker, regardless of the user and group they run as.
+            This is useful for units with `DynamicUser=`. Requires Linux 6.5 or later.
+          '';
+        };
         neededForUsers = lib.mkOption {
           type = lib.types.bool;
           default = false;
@@ -178,6 +429,34 @@ let
     }
   );
 
+  sshKeyPassphraseType = lib.types.submodule {
+    options = {
+      file = lib.mkOption {
+        type = lib.types.nullOr pathNotInStore;
+        default = null;
+        example = "/var/lib/sops-nix/ssh-key-passphrase";
+        description = ''
+          File containing the passphrase of the ssh key.
+          A trailing newline is ignored.
+        '';
+      };
+      credential = lib.mkOption {
+        type = lib.types.nullOr lib.types.str;
+        default = null;
+        example = "sops-ssh-key-passphrase";
+        description = ''
+          Name of a systemd credential containing the passphrase of the ssh key.
+          The credential is imported into the sops-install-secrets unit with `ImportCredential=`,
+          so this requires {option}`sops.useSystemdActivation`.
+        '';
+      };
+    };
+  };
+
+  passphraseCredentials = lib.unique (
+    lib.filter (c: c != null) (map (p: p.credential) (lib.attrValues cfg.sshKeyPassphrases))
+  );
+
   # Skip ssh keys deployed with sops to avoid a catch 22
   defaultImportKeys =
     algo:
@@ -220,7 +499,7 @@ in
       default = null;
       description = ''
         Default key used to lookup in all secrets.
-        This option is ignored if format is binary.
+        This option is ignored if format is binary, age or pgp.
         "" means whole file.
       '';
     };
@@ -234,11 +513,144 @@ in
       '';
     };
 
+    watch = lib.mkOption {
+      type = lib.types.bool;
+      default = false;
+      description = ''
+        Run `sops-install-secrets-watch.service`, which installs a new generation of secrets whenever a sops file
+        or template file changes, for example when sops files are delivered outside of Nix.
+        The `restartUnits` and `reloadUnits` of changed secrets and templates are restarted or reloaded,
+        and `onChange` commands are run.
+        Only sops files outside of the nix store can change, so this requires `validateSopsFiles = false`.
+        Secrets with `delivery = "broker"` are not refreshed: `sops-secret-broker.service` keeps the values
+        it decrypted when it started until it is restarted.
+      '';
+    };
+
     keepGenerations = lib.mkOption {
       type = lib.types.ints.unsigned;
       default = 1;
       description = ''
-        Number of secrets generations to keep. Setting this to 0 disables pruning.
+        Number of secrets generations to keep. Setting this to 0 disables pruning by count.
+        Generations younger than `maxGenerationAge` are kept in addition.
+      '';
+    };
+
+    maxGenerationAge = lib.mkOption {
+      type = lib.types.nullOr lib.types.str;
+      default = null;
+      example = "24h";
+      description = ''
+        Keep all secrets generations younger than this duration, for example `"36h"` or `"90m"`,
+        even beyond `keepGenerations`. Older generations are pruned once they exceed `keepGenerations`.
+        The current generation is never pruned.
+        To retain generations by age only, set `keepGenerations` to 0.
+      '';
+    };
+
+    maxGenerationsBytes = lib.mkOption {
+      type = lib.types.ints.unsigned;
+      default = 0;
+      description = ''
+        Prune the oldest secrets generations until all generations together use at most this many bytes.
+        The current generation is never pruned. Setting this to 0 disables pruning by size.
+      '';
+    };
+
+    maxSopsFileAge = lib.mkOption {
+      type = lib.types.nullOr lib.types.str;
+      default = null;
+      example = "2160h";
+      description = ''
+        Maximum time since a sops file was last rotated, for example `"2160h"` for 90 days.
+        The file counts as rotated at the oldest of its `lastmodified` date and the `created_at` dates of its master keys
+        in its sops metadata. Editing a file only resets `lastmodified`. `created_at` is reset when a master key is added
+        to the file again, for example with `sops rotate --rm-pgp` followed by `sops rotate --add-pgp`.
+        age keys have no `created_at` date.
+        Older files are reported when the sops files are validated at build time and during activation.
+        Files in the `age` and `pgp` formats have no sops metadata and are not checked.
+      '';
+    };
+
+    expiredSopsFiles = lib.mkOption {
+      type = lib.types.enum [
+        "warn"
+        "error"
+      ];
+      default = "warn";
+      description = ''
+        Whether a sops file that is older than `maxSopsFileAge` is reported as a warning or fails the build and activation.
+      '';
+    };
+
+    decryptionWorkers = lib.mkOption {
+      type = lib.types.ints.unsigned;
+      default = 0;
+      description = ''
+        Maximum number of sops files decrypted in parallel.
+        Setting this to 0 uses the number of available CPUs.
+      '';
+    };
+
+    unknownUnits = lib.mkOption {
+      type = lib.types.enum [
+        "ignore"
+        "warn"
+        "error"
+      ];
+      default = "warn";
+      description = ''
+        What to do if `restartUnits` or `reloadUnits` of a secret or template refer to a unit that does not exist.
+        Units are checked when the system is built, against all units of the new system,
+        including the units that come with packages in `systemd.packages`. `"error"` fails the build.
+        Units are not checked during activation.
+      '';
+    };
+
+    unitJobTimeout = lib.mkOption {
+      type = lib.types.nullOr lib.types.str;
+      default = null;
+      example = "30s";
+      description = ''
+        How long `sops-install-secrets rollback` and `sops.watch` wait for the restart and reload jobs
+        of units whose secrets changed, for example `"30s"`.
+        The result of every job is reported in the output of `sops-install-secrets`.
+        By default, jobs are only enqueued and not waited for.
+
+        This timeout only applies to rollbacks and to watch mode.
+        It has no effect on activation (`nixos-rebuild switch` and boot): there, jobs are always only enqueued,
+        as they can only run once `sops-install-secrets.service` has finished.
+      '';
+    };
+
+    brokerSocket = lib.mkOption {
+      type = lib.types.str;
+      default = "/run/sops-nix/broker.sock";
+      description = ''
+        Socket of `sops-secret-broker.service`, which serves the secrets with `delivery = "broker"`.
+      '';
+    };
+
+    onChangeTimeout = lib.mkOption {
+      type = lib.types.str;
+      default = "1m";
+      description = ''
+        How long the `onChange` command of a secret or template may run before it is killed.
+        A failing or killed command fails the activation after all other commands were run.
+      '';
+    };
+
+    decryptionFailurePolicy = lib.mkOption {
+      type = lib.types.enum [
+        "abort"
+        "keep-previous"
+      ];
+      default = "abort";
+      description = ''
+        What to do if a secret cannot be decrypted.
+        With `"abort"`, no secrets are installed and the activation fails.
+        With `"keep-previous"`, secrets that are not `required` keep the file of the previous generation
+        and a warning is logged. If there is no previous generation, for example at boot, the secret is not installed.
       '';
     };
 
@@ -256,6 +668,20 @@ in
       description = "What to log";
     };
 
+    outputFormat = lib.mkOption {
+      type = lib.types.enum [
+        "text"
+        "json"
+      ];
+      default = "text";
+      description = ''
+        Output format of sops-install-secrets during activation.
+        With "json", one JSON object per line is written to stdout for each event
+        (imported keys, added/modified/removed secrets, restarted/reloaded units, created/pruned generations and errors),
+        so that deployment tooling can consume the activation result.
+      '';
+    };
+
     environment = lib.mkOption {
       type = lib.types.attrsOf (lib.types.either lib.types.str lib.types.path);
       default = { };
@@ -333,6 +759,21 @@ in
       '';
     };
 
+    sshKeyPassphrases = lib.mkOption {
+      type = lib.types.attrsOf sshKeyPassphraseType;
+      default = { };
+      example = lib.literalExpression ''
+        {
+          "/etc/ssh/ssh_host_ed25519_key".file = "/var/lib/sops-nix/ssh-key-passphrase";
+        }
+      '';
+      description = ''
+        Passphrases of encrypted ssh keys listed in {option}`sops.age.sshKeyPaths` or
+        {option}`sops.gnupg.sshKeyPaths`, by key path.
+        Encrypted keys without a passphrase are skipped.
+      '';
+    };
+
     age = {
       keyFile = lib.mkOption {
         type = lib.types.nullOr pathNotInStore;
@@ -387,6 +828,7 @@ in
         defaultText = lib.literalMD "The rsa keys from {option}`config.services.openssh.hostKeys`";
         description = ''
           Path to ssh keys added as GPG keys during sops description.
+          RSA, ECDSA and Ed25519 keys are supported.
           This option must be explicitly unset if <literal>config.sops.gnupg.home</literal> is set.
         '';
       };
@@ -443,7 +885,19 @@ in
           assertion = !(cfg.gnupg.home != null && cfg.gnupg.sshKeyPaths != [ ]);
           message = "Exactly one of sops.gnupg.home and sops.gnupg.sshKeyPaths must be set";
         }
+        {
+          assertion = passphraseCredentials != [ ] -> cfg.useSystemdActivation;
+          message = "sops.sshKeyPassphrases.<path>.credential requires sops.useSystemdActivation";
+        }
+        {
+          assertion = cfg.watch -> !cfg.validateSopsFiles;
+          message = "sops.watch requires sops.validateSopsFiles to be false";
+        }
       ]
+      ++ lib.mapAttrsToList (keyPath: passphrase: {
+        assertion = (passphrase.file == null) != (passphrase.credential == null);
+        message = "Exactly one of file and credential must be set in sops.sshKeyPassphrases.\"${keyPath}\"";
+      }) cfg.sshKeyPassphrases
       ++ lib.optionals cfg.validateSopsFiles (
         lib.concatLists (
           lib.mapAttrsToList (name: secret: [
@@ -483,8 +937,9 @@ in
 
             serviceConfig = {
               Type = "oneshot";
-              ExecStart = [ "${cfg.package}/bin/sops-install-secrets ${manifest}" ];
+              ExecStart = [ "${cfg.package}/bin/sops-install-secrets ${outputFlag}${manifest}" ];
               RemainAfterExit = true;
+              ImportCredential = passphraseCredentials;
             };
             unitConfig.RequiresMountsFor = lib.concatLists [
               (lib.lists.optional (cfg.gnupg.home != null) cfg.gnupg.home)
@@ -494,6 +949,52 @@ in
             ];
           };
 
+      systemd.services.sops-secret-broker = lib.mkIf (brokerSecrets != { }) {
+        wantedBy = [ "multi-user.target" ];
+        after = [ "local-fs.target" ];
+        # Secrets are only decrypted when the broker starts.
+        restartTriggers = [ manifest ];
+        environment = cfg.environment;
+        path = cfg.age.plugins;
+        serviceConfig = {
+          Type = "notify";
+          NotifyAccess = "main";
+          ExecStart = [
+            "${cfg.package}/bin/sops-install-secrets serve -socket=${cfg.brokerSocket} ${outputFlag}${manifest}"
+          ];
+          ImportCredential = passphraseCredentials;
+          Restart = "on-failure";
+        };
+        unitConfig.RequiresMountsFor = lib.concatLists [
+          (lib.lists.optional (cfg.gnupg.home != null) cfg.gnupg.home)
+          cfg.gnupg.sshKeyPaths
+          (lib.lists.optional (cfg.age.keyFile != null) cfg.age.keyFile)
+          cfg.age.sshKeyPaths
+        ];
+      };
+
+      systemd.services.sops-install-secrets-watch = lib.mkIf (regularSecrets != { } && cfg.watch) {
+        wantedBy = [ "multi-user.target" ];
+        after = [ "local-fs.target" ] ++ lib.optional cfg.useSystemdActivation "sops-install-secrets.service";
+        restartTriggers = [ manifest ];
+        environment = cfg.environment;
+        path = cfg.age.plugins;
+        serviceConfig = {
+          # Ready once the secrets were installed for the first time.
+          Type = "notify";
+          NotifyAccess = "main";
+          ExecStart = [ "${cfg.package}/bin/sops-install-secrets -watch ${outputFlag}${manifest}" ];
+          ImportCredential = passphraseCredentials;
+          Restart = "on-failure";
+        };
+        unitConfig.RequiresMountsFor = lib.concatLists [
+          (lib.lists.optional (cfg.gnupg.home != null) cfg.gnupg.home)
+          cfg.gnupg.sshKeyPaths
+          (lib.lists.optional (cfg.age.keyFile != null) cfg.age.keyFile)
+          cfg.age.sshKeyPaths
+        ];
+      };
+
       system.activationScripts = {
         setupSecrets = lib.mkIf (regularSecrets != { } && !cfg.useSystemdActivation) (
           lib.stringAfter
@@ -507,7 +1008,7 @@ in
             )
             ''
               [ -e /run/current-system ] || echo setting up secrets...
-              ${withEnvironment "${sops-install-secrets}/bin/sops-install-secrets ${manifest}"}
+              ${withEnvironment "${sops-install-secrets}/bin/sops-install-secrets ${outputFlag}${manifest}"}
             ''
           // lib.optionalAttrs (config.system ? dryActivationScript) {
             supportsDryActivation = true;
@@ -533,5 +1034,15 @@ in
     {
       system.build.sops-nix-manifest = manifest;
     }
+    (lib.mkIf (regularSecrets != { } && cfg.unknownUnits != "ignore") {
+      # The manifest cannot refer to the units, which refer to the manifest.
+      system.checks = [
+        (pkgs.runCommand "sops-nix-units-check" { } ''
+          ${cfg.validationPackage}/bin/sops-install-secrets -check-mode=manifest \
+            -systemd-units=${config.environment.etc."systemd/system".source} ${manifest}
+          touch $out
+        '')
+      ];
+    })
   ];
 }
@@ -37,10 +37,20 @@ else
         secretsMountPoint = "/run/secrets.d";
         symlinkPath = "/run/secrets";
         keepGenerations = cfg.keepGenerations;
+        maxGenerationAge = cfg.maxGenerationAge;
+        maxGenerationsBytes = cfg.maxGenerationsBytes;
+        maxSopsFileAge = cfg.maxSopsFileAge;
+        expiredSopsFiles = cfg.expiredSopsFiles;
+        decryptionWorkers = cfg.decryptionWorkers;
+        decryptionFailurePolicy = cfg.decryptionFailurePolicy;
+        unknownUnits = cfg.unknownUnits;
+        unitJobTimeout = cfg.unitJobTimeout;
+        onChangeTimeout = cfg.onChangeTimeout;
         gnupgHome = cfg.gnupg.home;
         sshKeyPaths = cfg.gnupg.sshKeyPaths;
         ageKeyFile = cfg.age.keyFile;
         ageSshKeyPaths = cfg.age.sshKeyPaths;
+        sshKeyPassphrases = cfg.sshKeyPassphrases;
         useTmpfs = cfg.useTmpfs;
         placeholderBySecretName = cfg.placeholder;
         userMode = false;
@@ -25,6 +25,7 @@ let
     secretsMountPoint = "/run/secrets-for-users.d";
     symlinkPath = "/run/secrets-for-users";
   };
+  outputFlag = lib.optionalString (cfg.outputFormat != "text") "-output=${cfg.outputFormat} ";
   sysusersEnabled = options.systemd ? sysusers && config.systemd.sysusers.enable;
   useSystemdActivation =
     sysusersEnabled || (options.services ? userborn && config.services.userborn.enable);
@@ -43,8 +44,11 @@ in
 
         serviceConfig = {
           Type = "oneshot";
-          ExecStart = [ "${cfg.package}/bin/sops-install-secrets -ignore-passwd ${manifestForUsers}" ];
+          ExecStart = [ "${cfg.package}/bin/sops-install-secrets -ignore-passwd ${outputFlag}${manifestForUsers}" ];
           RemainAfterExit = true;
+          ImportCredential = lib.unique (
+            lib.filter (c: c != null) (map (p: p.credential) (lib.attrValues cfg.sshKeyPassphrases))
+          );
         };
         unitConfig.RequiresMountsFor = lib.concatLists [
           (lib.lists.optional (cfg.gnupg.home != null) cfg.gnupg.home)
@@ -58,7 +62,7 @@ in
     setupSecretsForUsers =
       lib.stringAfter ([ "specialfs" ] ++ lib.optional cfg.age.generateKey "generate-age-key") ''
         [ -e /run/current-system ] || echo setting up secrets for users...
-        ${withEnvironment "${cfg.package}/bin/sops-install-secrets -ignore-passwd ${manifestForUsers}"}
+        ${withEnvironment "${cfg.package}/bin/sops-install-secrets -ignore-passwd ${outputFlag}${manifestForUsers}"}
       ''
       // lib.optionalAttrs (config.system ? dryActivationScript) {
         supportsDryActivation = true;
@@ -71,9 +75,12 @@ in
     {
       assertion =
         (lib.filterAttrs (
-          _: v: (v.uid != 0 && v.owner != "root") || (v.gid != 0 && v.group != "root")
+          _: v:
+          lib.any (f: (f.uid != 0 && f.owner != "root") || (f.gid != 0 && f.group != "root")) (
+            [ v ] ++ builtins.attrValues v.hashes
+          )
         ) secretsForUsers) == { };
-      message = "neededForUsers cannot be used for secrets that are not root-owned";
+      message = "neededForUsers cannot be used for secrets or hashes that are not root-owned";
     }
     {
       assertion = secretsForUsers != { } && sysusersEnabled -> config.users.mutableUsers;
@@ -89,6 +89,20 @@ in
                   File used as the template. When this value is specified, `sops.templates.<name>.content` is ignored.
                 '';
               };
+              engine = mkOption {
+                type = types.enum [
+                  "placeholder"
+                  "go-template"
+                ];
+                default = "placeholder";
+                description = ''
+                  How the template is rendered.
+                  `placeholder` replaces `config.sops.placeholder.<name>` with the secret.
+                  `go-template` renders the template with Go's text/template, secrets are inserted
+                  with `{{ secret "<name>" }}` and can be piped to `b64enc`, `json`, `shellQuote`,
+                  `urlquery`, `indent <n>` and `sha256`.
+                '';
+              };
               restartUnits = lib.mkOption {
                 type = lib.types.listOf lib.types.str;
                 default = [ ];
@@ -107,6 +121,14 @@ in
                   This works the same way as <xref linkend="opt-systemd.services._name_.reloadTriggers" />.
                 '';
               };
+              onChange = lib.mkOption {
+                type = lib.types.nullOr lib.types.str;
+                default = null;
+                description = ''
+                  Shell command that is run with `/bin/sh` when the rendered template is added or changed,
+                  like the `onChange` option of secrets.
+                '';
+              };
             };
           }
         )
@@ -129,6 +151,7 @@ in
 
   config = lib.optionalAttrs (options ? sops.secrets) (
     lib.mkIf (config.sops.templates != { }) {
+      # Keep this in sync with `placeholderPattern` in `pkgs/sops-install-secrets/templates.go`
       sops.placeholder = mapAttrs (
         name: _: mkDefault "<SOPS:${builtins.hashString "sha256" name}:PLACEHOLDER>"
       ) config.sops.secrets;
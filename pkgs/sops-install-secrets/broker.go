@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultBrokerSocket is the default of -socket.
+const DefaultBrokerSocket = "/run/sops-nix/broker.sock"
+
+// brokerTimeout bounds how long a client may take to send its request and
+// read the answer.
+const brokerTimeout = 10 * time.Second
+
+// maxBrokerRequest is the longest request line accepted by the broker.
+const maxBrokerRequest = 4096
+
+// peer is the process on the other end of a connection to the broker.
+// Groups and Unit are only known if the kernel can tie them to the process
+// that connected, see peerCredentials.
+type peer struct {
+	PID    int    `json:"pid"`
+	UID    int    `json:"uid"`
+	GID    int    `json:"gid"`
+	Groups []int  `json:"groups,omitempty"`
+	Unit   string `json:"unit,omitempty"`
+}
+
+func (p *peer) String() string {
+	s := fmt.Sprintf("pid=%d uid=%d gid=%d", p.PID, p.UID, p.GID)
+	if p.Unit != "" {
+		s += " unit=" + p.Unit
+	}
+	return s
+}
+
+// parseStatusGroups returns the supplementary groups from the contents of
+// /proc/<pid>/status.
+func parseStatusGroups(status []byte) ([]int, error) {
+	for _, line := range strings.Split(string(status), "\n") {
+		fields, ok := strings.CutPrefix(line, "Groups:")
+		if !ok {
+			continue
+		}
+		var groups []int
+		for _, field := range strings.Fields(fields) {
+			gid, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid group '%s'", field)
+			}
+			groups = append(groups, gid)
+		}
+		return groups, nil
+	}
+	return nil, errors.New("no Groups line")
+}
+
+// cgroupUnit returns the systemd unit from the contents of
+// /proc/<pid>/cgroup, which is the first part of the unified hierarchy path
+// that is not a slice. Processes of user units are accounted to the
+// user@.service of their manager.
+func cgroupUnit(cgroup []byte) string {
+	for _, line := range strings.Split(string(cgroup), "\n") {
+		path, ok := strings.CutPrefix(line, "0::")
+		if !ok {
+			continue
+		}
+		for _, part := range strings.Split(path, "/") {
+			if part != "" && !strings.HasSuffix(part, ".slice") {
+				return part
+			}
+		}
+	}
+	return ""
+}
+
+// brokerAllowed reports whether p may read s. The file mode of the secret
+// is applied to its owner and group, as if p opened the secret file. In
+// addition, processes of the units in brokerUnits may always read it.
+func brokerAllowed(s *secret, p *peer) bool {
+	switch {
+	case p.UID == 0:
+		return true
+	case s.mode&0o004 != 0:
+		return true
+	case p.UID == s.owner && s.mode&0o400 != 0:
+		return true
+	case (p.GID == s.group || slices.Contains(p.Groups, s.group)) && s.mode&0o040 != 0:
+		return true
+	}
+	if p.Unit == "" {
+		return false
+	}
+	for _, unit := range s.BrokerUnits {
+		if unitName(unit) == p.Unit {
+			return true
+		}
+	}
+	return false
+}
+
+// brokerSecrets returns the secrets that are served by the broker.
+func brokerSecrets(secrets []secret) []secret {
+	var served []secret
+	for _, secret := range secrets {
+		if secret.Delivery == BrokerDelivery {
+			served = append(served, secret)
+		}
+	}
+	return served
+}
+
+// withoutBrokerSecrets returns the secrets that are installed into a
+// generation.
+func withoutBrokerSecrets(secrets []secret) []secret {
+	var installed []secret
+	for _, secret := range secrets {
+		if secret.Delivery != BrokerDelivery {
+			installed = append(installed, secret)
+		}
+	}
+	return installed
+}
+
+// listenBroker creates the socket of the broker. Everyone may connect,
+// requests are authorized by the credentials of the peer.
+func listenBroker(socketPath string) (*net.UnixListener, error) {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0o755); err != nil {
+		return nil, fmt.Errorf("cannot create directory '%s': %w", filepath.Dir(socketPath), err)
+	}
+	// Remove the socket left behind by a previous broker.
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot remove '%s': %w", socketPath, err)
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on '%s': %w", socketPath, err)
+	}
+	if err := os.Chmod(socketPath, 0o666); err != nil {
+		_ = l.Close()
+		return nil, fmt.Errorf("cannot chmod '%s': %w", socketPath, err)
+	}
+	return l, nil
+}
+
+// serve decrypts the secrets delivered by the broker and serves them on
+// socketPath. New values are only picked up by restarting the broker.
+func serve(logcfg loggingConfig, socketPath string, secrets []secret, workers int) error {
+	if err := decryptSecrets(secrets, workers); err != nil {
+		return err
+	}
+	l, err := listenBroker(socketPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = l.Close() }()
+	if err := sdNotify("READY=1"); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot notify systemd: %s\n", err)
+	}
+	return serveSecrets(logcfg, l, secrets)
+}
+
+// serveSecrets answers requests for secrets on l until it fails. The values
+// are only kept in memory. Every request is logged with the credentials of
+// the peer.
+func serveSecrets(logcfg loggingConfig, l *net.UnixListener, secrets []secret) error {
+	byName := make(map[string]*secret, len(secrets))
+	for i := range secrets {
+		byName[secrets[i].Name] = &secrets[i]
+	}
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return fmt.Errorf("cannot accept connection: %w", err)
+		}
+		go func() {
+			defer func() { _ = conn.Close() }()
+			if err := handleBrokerRequest(logcfg, conn, byName); err != nil {
+				fmt.Fprintf(os.Stderr, "broker request failed: %s\n", err)
+			}
+		}()
+	}
+}
+
+func handleBrokerRequest(logcfg loggingConfig, conn *net.UnixConn, secrets map[string]*secret) error {
+	if err := conn.SetDeadline(time.Now().Add(brokerTimeout)); err != nil {
+		return err
+	}
+	p, err := peerCredentials(conn)
+	if err != nil {
+		return fmt.Errorf("cannot get peer credentials: %w", err)
+	}
+	line, err := bufio.NewReader(io.LimitReader(conn, maxBrokerRequest)).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("cannot read request of %s: %w", p, err)
+	}
+	name, ok := strings.CutPrefix(strings.TrimSuffix(line, "\n"), "GET ")
+	if !ok {
+		_, err := fmt.Fprintf(conn, "ERR invalid request\n")
+		return err
+	}
+
+	// Unknown secrets are denied like forbidden ones, so that callers cannot
+	// find out which secrets exist.
+	s, ok := secrets[name]
+	allowed := ok && brokerAllowed(s, p)
+	result := "denied"
+	if allowed {
+		result = "granted"
+	}
+	logcfg.emit(event{Event: EventSecretRequested, Name: name, Peer: p, Result: result})
+	if !logcfg.jsonOutput() {
+		fmt.Printf("%s secret %s to %s\n", result, name, p)
+	}
+
+	if !allowed {
+		_, err := fmt.Fprintf(conn, "ERR permission denied\n")
+		return err
+	}
+	if _, err := fmt.Fprintf(conn, "OK %d\n", len(s.value)); err != nil {
+		return err
+	}
+	_, err = conn.Write(s.value)
+	return err
+}
+
+// fetchSecret asks the broker listening on socketPath for the secret name
+// and writes its value to w.
+func fetchSecret(socketPath string, name string, w io.Writer) error {
+	if strings.Contains(name, "\n") {
+		return fmt.Errorf("invalid secret name %q", name)
+	}
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		return fmt.Errorf("cannot connect to broker: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if err := conn.SetDeadline(time.Now().Add(brokerTimeout)); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(conn, "GET %s\n", name); err != nil {
+		return fmt.Errorf("cannot send request: %w", err)
+	}
+
+	r := bufio.NewReader(conn)
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("cannot read answer of broker: %w", err)
+	}
+	header = strings.TrimSuffix(header, "\n")
+	if msg, ok := strings.CutPrefix(header, "ERR "); ok {
+		return fmt.Errorf("cannot get secret %s: %s", name, msg)
+	}
+	size, err := strconv.ParseInt(strings.TrimPrefix(header, "OK "), 10, 64)
+	if !strings.HasPrefix(header, "OK ") || err != nil || size < 0 {
+		return fmt.Errorf("invalid answer of broker: %q", header)
+	}
+	if _, err := io.CopyN(w, r, size); err != nil {
+		return fmt.Errorf("cannot read secret %s: %w", name, err)
+	}
+	return nil
+}
+
+// getSecret runs the get subcommand.
+func getSecret(opts *options) error {
+	w := os.Stdout
+	if opts.fd >= 0 {
+		w = os.NewFile(uintptr(opts.fd), "fd "+strconv.Itoa(opts.fd))
+	}
+	return fetchSecret(opts.socket, opts.secretName, w)
+}
@@ -5,6 +5,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"strings"
@@ -91,3 +92,39 @@ func MountSecretFs(mountpoint string, keysGID int, _useTmpfs bool, userMode bool
 
 	return nil
 }
+
+func watchFiles(paths []string) (<-chan string, error) {
+	return nil, errors.New("watching files is not supported on macOS")
+}
+
+var errNoKernelKeyring = errors.New("the kernel keyring is not supported on macOS")
+
+// findKernelKeyring reports that there is no keyring, so that there is
+// nothing to update or revoke unless a secret is delivered by keyring.
+func findKernelKeyring(name string) (int, error) {
+	return 0, nil
+}
+
+func createKernelKeyring(name string, perm uint32) (int, error) {
+	return 0, errNoKernelKeyring
+}
+
+func readKernelKey(keyring int, description string) ([]byte, bool, error) {
+	return nil, false, errNoKernelKeyring
+}
+
+func setKernelKey(keyring int, description string, value []byte, uid, gid int, perm uint32) (int, error) {
+	return 0, errNoKernelKeyring
+}
+
+func listKernelKeys(keyring int) (map[string]int, error) {
+	return nil, errNoKernelKeyring
+}
+
+func revokeKernelKey(keyring int, id int) error {
+	return errNoKernelKeyring
+}
+
+func peerCredentials(conn *net.UnixConn) (*peer, error) {
+	return nil, errors.New("the broker is not supported on macOS")
+}
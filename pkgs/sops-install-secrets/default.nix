@@ -5,7 +5,7 @@
   vendorHash,
   go,
 }:
-buildGo125Module {
+buildGo125Module rec {
   pname = "sops-install-secrets";
   version = "0.0.1";
 
@@ -17,6 +17,8 @@ buildGo125Module {
 
   subPackages = [ "pkgs/sops-install-secrets" ];
 
+  ldflags = [ "-X main.version=${version}" ];
+
   # requires root privileges for tests
   doCheck = false;
 
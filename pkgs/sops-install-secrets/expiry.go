@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/getsops/sops/v3/cmd/sops/common"
+	"github.com/getsops/sops/v3/cmd/sops/formats"
+	"github.com/getsops/sops/v3/config"
+)
+
+type ExpiredSopsFilesPolicy string
+
+const (
+	WarnExpiredSopsFiles   ExpiredSopsFilesPolicy = "warn"
+	RejectExpiredSopsFiles ExpiredSopsFilesPolicy = "error"
+)
+
+func (p *ExpiredSopsFilesPolicy) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	switch t := ExpiredSopsFilesPolicy(s); t {
+	case "":
+		*p = WarnExpiredSopsFiles
+	case WarnExpiredSopsFiles, RejectExpiredSopsFiles:
+		*p = t
+	default:
+		return fmt.Errorf("unknown policy for expired sops files '%s'", s)
+	}
+	return nil
+}
+
+// sopsLastRotated returns the oldest of the time the sops file was last
+// modified and the times its master keys were added, as recorded in its
+// metadata by sops. Editing a file only updates lastmodified, so a file
+// whose data key was never encrypted again for its master keys still counts
+// as old. sops does not record created_at for age keys. The file is not
+// decrypted.
+func sopsLastRotated(cipherText []byte, format FormatType) (time.Time, error) {
+	store := common.StoreForFormat(formats.FormatFromString(string(format)), config.NewStoresConfig())
+	tree, err := store.LoadEncryptedFile(cipherText)
+	if err != nil {
+		return time.Time{}, err
+	}
+	rotated := tree.Metadata.LastModified
+	for _, group := range tree.Metadata.KeyGroups {
+		for _, key := range group {
+			createdAt, ok := key.ToMap()["created_at"].(string)
+			if !ok {
+				continue
+			}
+			created, err := time.Parse(time.RFC3339, createdAt)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("cannot parse created_at of master key %s: %w", key.ToString(), err)
+			}
+			if created.Before(rotated) {
+				rotated = created
+			}
+		}
+	}
+	return rotated, nil
+}
+
+// checkSopsFileAge reports sops files that were not rotated within
+// maxSopsFileAge. Files in the age and pgp formats carry no sops metadata
+// and are skipped.
+func (app *appContext) checkSopsFileAge() error {
+	m := &app.manifest
+	if m.maxSopsFileAge == 0 || app.checkMode == Manifest {
+		return nil
+	}
+
+	paths := make([]string, 0, len(app.secretFiles))
+	for path := range app.secretFiles {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	now := time.Now()
+	var errs []error
+	for _, path := range paths {
+		file := app.secretFiles[path]
+		if format := file.firstSecret.Format; format == Age || format == PGP {
+			continue
+		}
+		rotated, err := sopsLastRotated(file.cipherText, file.firstSecret.Format)
+		if err != nil {
+			return fmt.Errorf("cannot read sops metadata of '%s': %w", path, err)
+		}
+		if now.Sub(rotated) <= m.maxSopsFileAge {
+			continue
+		}
+		msg := fmt.Sprintf("sops file '%s' was last rotated at %s, more than maxSopsFileAge (%s) ago", path, rotated.UTC().Format(time.RFC3339), m.MaxSopsFileAge)
+		if m.ExpiredSopsFiles == RejectExpiredSopsFiles {
+			errs = append(errs, errors.New(msg))
+			continue
+		}
+		if m.Logging.jsonOutput() {
+			m.Logging.emit(event{Event: EventSopsFileExpired, Path: path, Time: rotated.UTC().Format(time.RFC3339)})
+		} else {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", msg)
+		}
+	}
+	return errors.Join(errs...)
+}
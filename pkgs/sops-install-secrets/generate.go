@@ -0,0 +1,467 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/aes"
+	"github.com/getsops/sops/v3/cmd/sops/common"
+	"github.com/getsops/sops/v3/cmd/sops/formats"
+	"github.com/getsops/sops/v3/config"
+	"github.com/getsops/sops/v3/keyservice"
+	sopsversion "github.com/getsops/sops/v3/version"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ssh"
+)
+
+type GenerateType string
+
+const (
+	GeneratePassword   GenerateType = "password"
+	GenerateHex        GenerateType = "hex"
+	GenerateBase64     GenerateType = "base64"
+	GenerateEd25519    GenerateType = "ed25519"
+	GenerateSSHEd25519 GenerateType = "ssh-ed25519"
+	GenerateWireguard  GenerateType = "wireguard"
+	GenerateAge        GenerateType = "age"
+)
+
+func (t *GenerateType) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	switch g := GenerateType(s); g {
+	case GeneratePassword, GenerateHex, GenerateBase64, GenerateEd25519, GenerateSSHEd25519, GenerateWireguard, GenerateAge:
+		*t = g
+	default:
+		return fmt.Errorf("unknown type of generated secret '%s'", s)
+	}
+	return nil
+}
+
+// DefaultPasswordCharset is used for passwords if the spec sets no charset.
+const DefaultPasswordCharset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// DefaultGenerateLength is the length of passwords in characters and of hex
+// and base64 values in bytes if the spec sets no length.
+const DefaultGenerateLength = 32
+
+// generateSpec describes how the value of a secret is created by the
+// generate subcommand if its key is missing from the sops file.
+type generateSpec struct {
+	Type GenerateType `json:"type"`
+	// Length of passwords in characters and of hex and base64 values in
+	// random bytes.
+	Length  int    `json:"length"`
+	Charset string `json:"charset"`
+	// PublicKey is the key in the same sops file that receives the public
+	// key of generated keypairs.
+	PublicKey string `json:"publicKey"`
+}
+
+func (g *generateSpec) keypair() bool {
+	switch g.Type {
+	case GenerateEd25519, GenerateSSHEd25519, GenerateWireguard, GenerateAge:
+		return true
+	}
+	return false
+}
+
+func validateGenerateSpec(s *secret) error {
+	g := s.Generate
+	switch s.Format {
+	case Yaml, JSON:
+	case Dotenv, Binary:
+		if g.PublicKey != "" {
+			return fmt.Errorf("secret %s cannot store the public key in a %s file", s.Name, s.Format)
+		}
+	default:
+		return fmt.Errorf("secret %s cannot be generated in a %s file", s.Name, s.Format)
+	}
+	if s.Key == "" && s.Format != Binary {
+		return fmt.Errorf("secret %s must set a key to be generated", s.Name)
+	}
+	if g.Length < 0 {
+		return fmt.Errorf("length of generated secret %s must not be negative", s.Name)
+	}
+	if g.Length != 0 && g.keypair() {
+		return fmt.Errorf("secret %s sets a length, but keys of type %s have a fixed length", s.Name, g.Type)
+	}
+	if g.Charset != "" && g.Type != GeneratePassword {
+		return fmt.Errorf("secret %s sets a charset, but only passwords use it", s.Name)
+	}
+	if g.PublicKey != "" && !g.keypair() {
+		return fmt.Errorf("secret %s sets publicKey, but %s is not a keypair", s.Name, g.Type)
+	}
+	return nil
+}
+
+// generateValue creates a new secret value according to g. For keypairs,
+// the private key is returned as the value together with the public key.
+func generateValue(g *generateSpec) (value string, public string, err error) {
+	length := g.Length
+	if length == 0 {
+		length = DefaultGenerateLength
+	}
+	switch g.Type {
+	case GeneratePassword:
+		charset := []rune(g.Charset)
+		if len(charset) == 0 {
+			charset = []rune(DefaultPasswordCharset)
+		}
+		password := make([]rune, length)
+		for i := range password {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
+			if err != nil {
+				return "", "", err
+			}
+			password[i] = charset[n.Int64()]
+		}
+		return string(password), "", nil
+	case GenerateHex, GenerateBase64:
+		buf := make([]byte, length)
+		if _, err := rand.Read(buf); err != nil {
+			return "", "", err
+		}
+		if g.Type == GenerateHex {
+			return hex.EncodeToString(buf), "", nil
+		}
+		return base64.StdEncoding.EncodeToString(buf), "", nil
+	case GenerateEd25519:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", "", err
+		}
+		privDer, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return "", "", err
+		}
+		pubDer, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return "", "", err
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDer})),
+			string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDer})), nil
+	case GenerateSSHEd25519:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", "", err
+		}
+		block, err := ssh.MarshalPrivateKey(priv, "")
+		if err != nil {
+			return "", "", err
+		}
+		sshPub, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			return "", "", err
+		}
+		return string(pem.EncodeToMemory(block)), string(ssh.MarshalAuthorizedKey(sshPub)), nil
+	case GenerateWireguard:
+		priv := make([]byte, curve25519.ScalarSize)
+		if _, err := rand.Read(priv); err != nil {
+			return "", "", err
+		}
+		// Clamp the scalar like `wg genkey`.
+		priv[0] &= 248
+		priv[31] = (priv[31] & 127) | 64
+		pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+		if err != nil {
+			return "", "", err
+		}
+		return base64.StdEncoding.EncodeToString(priv), base64.StdEncoding.EncodeToString(pub), nil
+	case GenerateAge:
+		identity, err := age.GenerateX25519Identity()
+		if err != nil {
+			return "", "", err
+		}
+		return identity.String(), identity.Recipient().String(), nil
+	}
+	return "", "", fmt.Errorf("unknown type of generated secret '%s'", g.Type)
+}
+
+// treePath converts the key of a secret to a path in a sops tree.
+func treePath(format FormatType, key string) ([]interface{}, error) {
+	if format == Dotenv {
+		return []interface{}{key}, nil
+	}
+	segments, err := parseKeyPath(key)
+	if err != nil {
+		return nil, err
+	}
+	path := make([]interface{}, len(segments))
+	for i, seg := range segments {
+		if seg.isIndex {
+			path[i] = seg.index
+		} else {
+			path[i] = seg.name
+		}
+	}
+	return path, nil
+}
+
+// sourcePath maps a sops file copied into the Nix store back to the file in
+// root it was copied from: /nix/store/<hash>-source/a/b.yaml becomes
+// root/a/b.yaml and /nix/store/<hash>-b.yaml becomes root/b.yaml. Other
+// paths are returned unchanged.
+func sourcePath(path string, root string) string {
+	rest, ok := strings.CutPrefix(path, "/nix/store/")
+	if !ok {
+		return path
+	}
+	storeObject, subPath, isDir := strings.Cut(rest, "/")
+	if isDir {
+		return filepath.Join(root, subPath)
+	}
+	if _, name, ok := strings.Cut(storeObject, "-"); ok {
+		return filepath.Join(root, name)
+	}
+	return path
+}
+
+// valueCipher remembers the ciphertext of every value it decrypts and
+// returns it again when the same value is encrypted at the same path, so
+// that re-encrypting a file only changes the values that were added.
+type valueCipher struct {
+	sops.Cipher
+	values map[string][]encryptedValue
+}
+
+type encryptedValue struct {
+	plainText  interface{}
+	cipherText string
+}
+
+func newValueCipher() *valueCipher {
+	return &valueCipher{Cipher: aes.NewCipher(), values: make(map[string][]encryptedValue)}
+}
+
+func (c *valueCipher) Decrypt(cipherText string, key []byte, additionalData string) (interface{}, error) {
+	plainText, err := c.Cipher.Decrypt(cipherText, key, additionalData)
+	if err == nil {
+		c.values[additionalData] = append(c.values[additionalData], encryptedValue{plainText, cipherText})
+	}
+	return plainText, err
+}
+
+func (c *valueCipher) Encrypt(plainText interface{}, key []byte, additionalData string) (string, error) {
+	for _, v := range c.values[additionalData] {
+		if reflect.DeepEqual(v.plainText, plainText) {
+			return v.cipherText, nil
+		}
+	}
+	return c.Cipher.Encrypt(plainText, key, additionalData)
+}
+
+// sopsFile is a decrypted sops file. dataKey is nil if the file does not
+// exist yet.
+type sopsFile struct {
+	tree    *sops.Tree
+	dataKey []byte
+	cipher  *valueCipher
+}
+
+// loadSopsFile decrypts the sops file at path. A missing file results in an
+// empty tree.
+func loadSopsFile(store common.Store, path string) (*sopsFile, error) {
+	file := &sopsFile{cipher: newValueCipher()}
+	cipherText, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		file.tree = &sops.Tree{Branches: sops.TreeBranches{sops.TreeBranch{}}}
+		return file, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read '%s': %w", path, err)
+	}
+	tree, err := store.LoadEncryptedFile(cipherText)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load '%s': %w", path, err)
+	}
+	// DecryptTree also verifies the MAC of the file.
+	file.dataKey, err = common.DecryptTree(common.DecryptTreeOpts{
+		Tree:        &tree,
+		KeyServices: []keyservice.KeyServiceClient{keyservice.NewLocalClient()},
+		Cipher:      file.cipher,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt '%s': %w", path, err)
+	}
+	file.tree = &tree
+	return file, nil
+}
+
+// encrypt encrypts the tree of file. Existing files keep their recipients
+// and data key; new files are encrypted for the recipients of the creation
+// rule in .sops.yaml that matches path.
+func (file *sopsFile) encrypt(store common.Store, path string) ([]byte, error) {
+	tree := file.tree
+	tree.FilePath = path
+	dataKey := file.dataKey
+	if dataKey == nil {
+		confPath, err := config.FindConfigFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot find .sops.yaml for '%s': %w", path, err)
+		}
+		conf, err := config.LoadCreationRuleForFile(confPath, path, nil)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load creation rule for '%s' from %s: %w", path, confPath, err)
+		}
+		if conf == nil {
+			return nil, fmt.Errorf("%s has no creation rules", confPath)
+		}
+		tree.Metadata = sops.Metadata{
+			KeyGroups:               conf.KeyGroups,
+			ShamirThreshold:         conf.ShamirThreshold,
+			UnencryptedSuffix:       conf.UnencryptedSuffix,
+			EncryptedSuffix:         conf.EncryptedSuffix,
+			UnencryptedRegex:        conf.UnencryptedRegex,
+			EncryptedRegex:          conf.EncryptedRegex,
+			UnencryptedCommentRegex: conf.UnencryptedCommentRegex,
+			EncryptedCommentRegex:   conf.EncryptedCommentRegex,
+			MACOnlyEncrypted:        conf.MACOnlyEncrypted,
+			Version:                 sopsversion.Version,
+		}
+		var errs []error
+		dataKey, errs = tree.GenerateDataKey()
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("cannot generate data key: %w", errors.Join(errs...))
+		}
+	}
+	if err := common.EncryptTree(common.EncryptTreeOpts{DataKey: dataKey, Tree: tree, Cipher: file.cipher}); err != nil {
+		return nil, err
+	}
+	return store.EmitEncryptedFile(*tree)
+}
+
+// generateMissingKeys adds values for the secrets whose keys are missing
+// from the sops file at path and re-encrypts it. The names of the generated
+// secrets are returned; if there are none, the file is left alone.
+func generateMissingKeys(path string, format FormatType, secrets []secret) ([]string, error) {
+	store := common.StoreForFormat(formats.FormatFromString(string(format)), config.NewStoresConfig())
+	file, err := loadSopsFile(store, path)
+	if err != nil {
+		return nil, err
+	}
+	tree := file.tree
+
+	var generated []string
+	for _, s := range secrets {
+		var keyPath []interface{}
+		if format == Binary {
+			if len(tree.Branches[0]) > 0 {
+				continue
+			}
+		} else {
+			keyPath, err = treePath(format, s.Key)
+			if err != nil {
+				return nil, fmt.Errorf("secret %s: %w", s.Name, err)
+			}
+			if _, err := tree.Branches[0].Truncate(keyPath); err == nil {
+				continue
+			}
+		}
+		value, public, err := generateValue(s.Generate)
+		if err != nil {
+			return nil, fmt.Errorf("cannot generate secret %s: %w", s.Name, err)
+		}
+		if format == Binary {
+			if tree.Branches, err = store.LoadPlainFile([]byte(value)); err != nil {
+				return nil, err
+			}
+			generated = append(generated, s.Name)
+			continue
+		}
+		tree.Branches[0], _ = tree.Branches[0].Set(keyPath, value)
+		if s.Generate.PublicKey != "" {
+			publicPath, err := treePath(format, s.Generate.PublicKey)
+			if err != nil {
+				return nil, fmt.Errorf("public key of secret %s: %w", s.Name, err)
+			}
+			tree.Branches[0], _ = tree.Branches[0].Set(publicPath, public)
+		}
+		generated = append(generated, s.Name)
+	}
+	if len(generated) == 0 {
+		return nil, nil
+	}
+
+	cipherText, err := file.encrypt(store, path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encrypt '%s': %w", path, err)
+	}
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, cipherText, mode); err != nil {
+		return nil, fmt.Errorf("cannot write '%s': %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return nil, fmt.Errorf("cannot rename '%s' to '%s': %w", tmp, path, err)
+	}
+	return generated, nil
+}
+
+// generateSecrets runs the generate subcommand: it fills in the missing keys
+// of all secrets with a generate spec, one sops file after another.
+func generateSecrets(opts *options, logcfg loggingConfig) error {
+	m, err := readManifest(opts.manifest)
+	if err != nil {
+		return err
+	}
+	var files []string
+	secretsByFile := make(map[string][]secret)
+	for _, s := range m.Secrets {
+		if s.Generate == nil {
+			continue
+		}
+		if s.Format == "" {
+			s.Format = Yaml
+		}
+		if err := validateGenerateSpec(&s); err != nil {
+			return err
+		}
+		path, err := filepath.Abs(sourcePath(s.SopsFile, opts.sourceRoot))
+		if err != nil {
+			return err
+		}
+		if _, ok := secretsByFile[path]; !ok {
+			files = append(files, path)
+		} else if secretsByFile[path][0].Format != s.Format {
+			return fmt.Errorf("secret %s defined the format of %s as %s, but it was specified as %s in %s before",
+				s.Name, path, s.Format, secretsByFile[path][0].Format, secretsByFile[path][0].Name)
+		}
+		secretsByFile[path] = append(secretsByFile[path], s)
+	}
+
+	for _, path := range files {
+		secrets := secretsByFile[path]
+		generated, err := generateMissingKeys(path, secrets[0].Format, secrets)
+		if err != nil {
+			return err
+		}
+		for _, name := range generated {
+			logcfg.emit(event{Event: EventSecretGenerated, Name: name, Path: path})
+			if !logcfg.jsonOutput() {
+				fmt.Printf("generated secret %s in %s\n", name, path)
+			}
+		}
+	}
+	return nil
+}
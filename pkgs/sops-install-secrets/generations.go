@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listGenerations returns the numbered generations in secretsMountPoint in
+// ascending order.
+func listGenerations(secretsMountPoint string) ([]int, error) {
+	entries, err := os.ReadDir(secretsMountPoint)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", secretsMountPoint, err)
+	}
+	var generations []int
+	for _, entry := range entries {
+		generation, err := strconv.Atoi(entry.Name())
+		// Not a number? Not relevant
+		if err != nil || generation <= 0 || !entry.IsDir() {
+			continue
+		}
+		generations = append(generations, generation)
+	}
+	sort.Ints(generations)
+	return generations, nil
+}
+
+// currentGeneration returns the generation symlinkPath points to.
+func currentGeneration(secretsMountPoint, symlinkPath string) (int, error) {
+	linkTarget, err := os.Readlink(symlinkPath)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read symlink %s: %w", symlinkPath, err)
+	}
+	if !strings.HasPrefix(linkTarget, secretsMountPoint) {
+		return 0, fmt.Errorf("%s points to %s, which is not a generation in %s", symlinkPath, linkTarget, secretsMountPoint)
+	}
+	generation, err := strconv.Atoi(filepath.Base(linkTarget))
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %s of %s as a number: %w", filepath.Base(linkTarget), linkTarget, err)
+	}
+	return generation, nil
+}
+
+// rollbackTarget picks the generation to roll back to. Without an explicit
+// generation, the newest generation older than the current one is used.
+func rollbackTarget(generations []int, current, wanted int) (int, error) {
+	if wanted == 0 {
+		for i := len(generations) - 1; i >= 0; i-- {
+			if generations[i] < current {
+				return generations[i], nil
+			}
+		}
+		return 0, fmt.Errorf("there is no generation older than the current generation %d", current)
+	}
+	if wanted == current {
+		return 0, fmt.Errorf("generation %d is already the current generation", wanted)
+	}
+	for _, generation := range generations {
+		if generation == wanted {
+			return wanted, nil
+		}
+	}
+	return 0, fmt.Errorf("generation %d does not exist, available generations: %s", wanted, formatGenerations(generations))
+}
+
+func formatGenerations(generations []int) string {
+	if len(generations) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(generations))
+	for _, generation := range generations {
+		names = append(names, strconv.Itoa(generation))
+	}
+	return strings.Join(names, ", ")
+}
+
+// checkGeneration makes sure all secrets and templates of the manifest are
+// present in dir, otherwise their symlinks would dangle after a rollback.
+func checkGeneration(dir string, secrets []secret, templates []template) error {
+	for _, secret := range secrets {
+		if _, err := os.Stat(filepath.Join(dir, secret.Name)); err != nil {
+			return fmt.Errorf("generation %s does not contain secret '%s': %w", dir, secret.Name, err)
+		}
+	}
+	for _, template := range templates {
+		if _, err := os.Stat(filepath.Join(dir, RenderedSubdir, template.Name)); err != nil {
+			return fmt.Errorf("generation %s does not contain rendered secret '%s': %w", dir, template.Name, err)
+		}
+	}
+	return nil
+}
+
+// rollbackGeneration points the secrets symlink back to an older generation
+// that is still retained in the mount point. Units of changed secrets are
+// restarted or reloaded over D-Bus once the symlink points to the target
+// generation, as there is no switch-to-configuration to pick them up.
+func rollbackGeneration(isDry bool, m *manifest, wanted int) error {
+	current, err := currentGeneration(m.SecretsMountPoint, m.SymlinkPath)
+	if err != nil {
+		return err
+	}
+	generations, err := listGenerations(m.SecretsMountPoint)
+	if err != nil {
+		return err
+	}
+	target, err := rollbackTarget(generations, current, wanted)
+	if err != nil {
+		return err
+	}
+	targetDir := filepath.Join(m.SecretsMountPoint, strconv.Itoa(target))
+	// Generations do not contain the values of secrets delivered by keyring,
+	// those keep their current value.
+	secrets := fileSecrets(m.Secrets)
+	if err := checkGeneration(targetDir, secrets, m.Templates); err != nil {
+		return err
+	}
+
+	var changes *generationChanges
+	if !m.UserMode {
+		changes, err = handleModifications(isDry, m.Logging, m.SymlinkPath, targetDir, secrets, m.Templates)
+		if err != nil {
+			return fmt.Errorf("cannot compare generations: %w", err)
+		}
+	}
+	hooks := changeHooks(changes, secrets, m.Templates)
+	m.Logging.emit(event{Event: EventGenerationRollback, Path: targetDir, Generation: target, Dry: isDry})
+	if !m.Logging.jsonOutput() {
+		if isDry {
+			fmt.Printf("would roll back secrets from generation %d to %d\n", current, target)
+		} else {
+			fmt.Printf("rolling back secrets from generation %d to %d\n", current, target)
+		}
+	}
+	// No need to perform the actual symlinking
+	if isDry {
+		if err := restartChangedUnits(isDry, m.Logging, m.UserMode, changes, 0); err != nil {
+			return err
+		}
+		return runHooks(isDry, m.Logging, hooks, m.onChangeTimeout)
+	}
+	if err := atomicSymlink(targetDir, m.SymlinkPath); err != nil {
+		return fmt.Errorf("cannot update secrets symlink: %w", err)
+	}
+	if err := symlinkSecretsAndTemplates(m.SymlinkPath, secrets, m.Templates, m.UserMode); err != nil {
+		return fmt.Errorf("failed to prepare symlinks to secret store: %w", err)
+	}
+	if err := restartChangedUnits(isDry, m.Logging, m.UserMode, changes, m.unitJobTimeout); err != nil {
+		return fmt.Errorf("cannot restart units: %w", err)
+	}
+	if err := runHooks(isDry, m.Logging, hooks, m.onChangeTimeout); err != nil {
+		return fmt.Errorf("onChange commands failed: %w", err)
+	}
+	return nil
+}
+
+// printGenerations lists the retained generations and marks the current one.
+func printGenerations(m *manifest) error {
+	generations, err := listGenerations(m.SecretsMountPoint)
+	if err != nil {
+		return err
+	}
+	current, err := currentGeneration(m.SecretsMountPoint, m.SymlinkPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, generation := range generations {
+		dir := filepath.Join(m.SecretsMountPoint, strconv.Itoa(generation))
+		created, err := generationTime(dir)
+		if err != nil {
+			return err
+		}
+		metadata, err := readGenerationMetadata(dir)
+		if err != nil {
+			return err
+		}
+		var manifestPath string
+		if metadata != nil {
+			manifestPath = metadata.Manifest.Path
+		}
+		if m.Logging.jsonOutput() {
+			m.Logging.emit(event{Event: EventGenerationListed, Generation: generation, Path: dir, Current: generation == current, Time: created.Format(time.RFC3339), Manifest: manifestPath})
+			continue
+		}
+		marker := ""
+		if generation == current {
+			marker = " (current)"
+		}
+		if manifestPath == "" {
+			manifestPath = "-"
+		}
+		fmt.Printf("%d\t%s\t%s\t%s%s\n", generation, created.Format(time.RFC3339), manifestPath, dir, marker)
+	}
+	return nil
+}
+
+// generationContents reconstructs the secrets and templates stored in a
+// generation, so that generations can be compared without the manifest
+// that created them.
+func generationContents(dir string) ([]secret, []template, error) {
+	var secrets []secret
+	var templates []template
+	renderedPath := filepath.Join(dir, RenderedSubdir)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || path == filepath.Join(dir, GenerationMetadataFile) {
+			return nil
+		}
+		if rel, err := filepath.Rel(renderedPath, path); err == nil && !strings.HasPrefix(rel, "..") {
+			templates = append(templates, template{Name: rel})
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		secrets = append(secrets, secret{Name: rel})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read generation %s: %w", dir, err)
+	}
+	return secrets, templates, nil
+}
+
+// diffGenerations reports which secrets and templates were added, modified
+// or removed from generation a to generation b. Only names are reported:
+// even a hash of a low-entropy value could be brute-forced.
+func diffGenerations(m *manifest, a, b int) error {
+	oldDir := filepath.Join(m.SecretsMountPoint, strconv.Itoa(a))
+	newDir := filepath.Join(m.SecretsMountPoint, strconv.Itoa(b))
+	for _, dir := range []string{oldDir, newDir} {
+		if _, err := os.Stat(dir); err != nil {
+			return fmt.Errorf("cannot access generation %s: %w", dir, err)
+		}
+	}
+
+	secrets, templates, err := generationContents(newDir)
+	if err != nil {
+		return err
+	}
+	changes, err := compareGenerations(oldDir, newDir, secrets, templates)
+	if err != nil {
+		return err
+	}
+	if err := changes.findRemoved(oldDir, secrets, templates); err != nil {
+		return err
+	}
+
+	type category struct {
+		noun, verb, eventName string
+		names                 map[string]bool
+		subdir                string
+	}
+	categories := []category{
+		{"secret", "added", EventSecretAdded, changes.newSecrets, ""},
+		{"secret", "modified", EventSecretModified, changes.modifiedSecrets, ""},
+		{"secret", "removed", EventSecretRemoved, changes.removedSecrets, ""},
+		{"rendered secret", "added", EventTemplateAdded, changes.newTemplates, RenderedSubdir},
+		{"rendered secret", "modified", EventTemplateModified, changes.modifiedTemplates, RenderedSubdir},
+		{"rendered secret", "removed", EventTemplateRemoved, changes.removedTemplates, RenderedSubdir},
+	}
+	for _, c := range categories {
+		names := make([]string, 0, len(c.names))
+		for name := range c.names {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if m.Logging.jsonOutput() {
+				m.Logging.emit(event{Event: c.eventName, Name: name})
+				continue
+			}
+			fmt.Printf("%s %s %s\n", c.verb, c.noun, name)
+		}
+	}
+	return nil
+}
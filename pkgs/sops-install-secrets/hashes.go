@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Mic92/sops-nix/pkgs/sops-install-secrets/passwordhash"
+)
+
+type HashAlgorithm string
+
+const (
+	SHA512CryptHash HashAlgorithm = HashAlgorithm(passwordhash.SHA512Crypt)
+	YescryptHash    HashAlgorithm = HashAlgorithm(passwordhash.Yescrypt)
+	BcryptHash      HashAlgorithm = HashAlgorithm(passwordhash.Bcrypt)
+	Argon2idHash    HashAlgorithm = HashAlgorithm(passwordhash.Argon2id)
+	// HtpasswdHash writes a line of a htpasswd file with a bcrypt hash.
+	HtpasswdHash HashAlgorithm = "htpasswd"
+)
+
+func (a *HashAlgorithm) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	switch t := HashAlgorithm(s); t {
+	case SHA512CryptHash, YescryptHash, BcryptHash, Argon2idHash, HtpasswdHash:
+		*a = t
+	default:
+		return fmt.Errorf("unknown hash algorithm '%s'", s)
+	}
+	return nil
+}
+
+// passwordHash is a file with a hash of the value of a secret, for example
+// for hashedPasswordFile of a user or the basic auth of a web server.
+type passwordHash struct {
+	Name      string        `json:"name"`
+	Algorithm HashAlgorithm `json:"algorithm"`
+	// User is the user name of htpasswd lines.
+	User  string  `json:"user"`
+	Path  string  `json:"path"`
+	Owner *string `json:"owner,omitempty"`
+	UID   int     `json:"uid"`
+	Group *string `json:"group,omitempty"`
+	GID   int     `json:"gid"`
+	Mode  string  `json:"mode"`
+	mode  os.FileMode
+	owner int
+	group int
+}
+
+func (h *passwordHash) hash(value []byte) (string, error) {
+	if h.Algorithm == HtpasswdHash {
+		hash, err := passwordhash.Hash(passwordhash.Bcrypt, value)
+		if err != nil {
+			return "", err
+		}
+		return h.User + ":" + hash + "\n", nil
+	}
+	return passwordhash.Hash(passwordhash.Algorithm(h.Algorithm), value)
+}
+
+// matches reports whether content, as written by hash, is a hash of value.
+func (h *passwordHash) matches(content string, value []byte) bool {
+	if h.Algorithm == HtpasswdHash {
+		hash, ok := strings.CutPrefix(content, h.User+":")
+		if !ok {
+			return false
+		}
+		hash, ok = strings.CutSuffix(hash, "\n")
+		return ok && passwordhash.Verify(passwordhash.Bcrypt, hash, value)
+	}
+	return passwordhash.Verify(passwordhash.Algorithm(h.Algorithm), content, value)
+}
+
+func (app *appContext) validatePasswordHash(s *secret, h *passwordHash) error {
+	mode, err := validateMode(h.Mode)
+	if err != nil {
+		return err
+	}
+	h.mode = mode
+
+	if app.ignorePasswd || os.Getenv("NIXOS_ACTION") == "dry-activate" {
+		h.owner = 0
+		h.group = 0
+	} else if app.checkMode == Off || app.ignorePasswd {
+		if h.Owner == nil {
+			h.owner = h.UID
+		} else {
+			owner, err := validateOwner(*h.Owner)
+			if err != nil {
+				return err
+			}
+			h.owner = owner
+		}
+
+		if h.Group == nil {
+			h.group = h.GID
+		} else {
+			group, err := validateGroup(*h.Group)
+			if err != nil {
+				return err
+			}
+			h.group = group
+		}
+	}
+
+	if h.Name == "" {
+		return fmt.Errorf("hash of secret %s has no name", s.Name)
+	}
+	if h.Name == GenerationMetadataFile {
+		return fmt.Errorf("hash name %s of secret %s is reserved for the generation metadata", h.Name, s.Name)
+	}
+	if h.Algorithm == "" {
+		return fmt.Errorf("hash %s of secret %s has no algorithm", h.Name, s.Name)
+	}
+	if h.Algorithm == HtpasswdHash {
+		if h.User == "" || strings.ContainsAny(h.User, ":\n") {
+			return fmt.Errorf("hash %s of secret %s needs a user without ':' for htpasswd", h.Name, s.Name)
+		}
+	} else if h.User != "" {
+		return fmt.Errorf("hash %s of secret %s sets a user, which is only used by htpasswd", h.Name, s.Name)
+	}
+	return nil
+}
+
+// sortedHashes returns the hashes of s ordered by name.
+func sortedHashes(s *secret) []*passwordHash {
+	hashes := make([]*passwordHash, 0, len(s.Hashes))
+	for _, h := range s.Hashes {
+		hashes = append(hashes, h)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return hashes[i].Name < hashes[j].Name
+	})
+	return hashes
+}
+
+// hashSecrets returns the files with the hashes of the installed secrets.
+// The hash of the previous generation in symlinkPath is kept if it still
+// matches the value, so that the file does not change with every new salt
+// and units are only restarted if the value changes.
+func hashSecrets(symlinkPath string, secrets []secret) ([]secret, error) {
+	var files []secret
+	for i := range secrets {
+		s := &secrets[i]
+		for _, h := range sortedHashes(s) {
+			var content string
+			previous, err := os.ReadFile(filepath.Join(symlinkPath, h.Name))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("cannot read previous hash %s of secret %s: %w", h.Name, s.Name, err)
+			}
+			if err == nil && h.matches(string(previous), s.value) {
+				content = string(previous)
+			} else {
+				content, err = h.hash(s.value)
+				if err != nil {
+					return nil, fmt.Errorf("cannot hash secret %s with %s: %w", s.Name, h.Algorithm, err)
+				}
+			}
+			files = append(files, secret{
+				Name:           h.Name,
+				Path:           h.Path,
+				SopsFile:       s.SopsFile,
+				Format:         s.Format,
+				Mode:           h.Mode,
+				RestartUnits:   s.RestartUnits,
+				ReloadUnits:    s.ReloadUnits,
+				Delivery:       FileDelivery,
+				value:          []byte(content),
+				mode:           h.mode,
+				owner:          h.owner,
+				group:          h.group,
+				sourceSHA256:   s.sourceSHA256,
+				keyType:        s.keyType,
+				carriedForward: s.carriedForward,
+			})
+		}
+	}
+	return files, nil
+}
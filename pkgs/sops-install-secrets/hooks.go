@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// DefaultOnChangeTimeout is used if the manifest does not set onChangeTimeout.
+const DefaultOnChangeTimeout = time.Minute
+
+// hook is an onChange command of a secret or template that changed.
+type hook struct {
+	kind    string
+	name    string
+	path    string
+	change  string
+	command string
+}
+
+func (h hook) String() string {
+	return fmt.Sprintf("onChange of %s %s", h.kind, h.name)
+}
+
+// changeHooks returns the onChange commands of the secrets and templates that
+// were added or modified, in the order of the manifest.
+func changeHooks(changes *generationChanges, secrets []secret, templates []template) []hook {
+	if changes == nil {
+		return nil
+	}
+	change := func(added, modified map[string]bool, name string) string {
+		switch {
+		case added[name]:
+			return "added"
+		case modified[name]:
+			return "modified"
+		}
+		return ""
+	}
+	var hooks []hook
+	for _, secret := range secrets {
+		c := change(changes.newSecrets, changes.modifiedSecrets, secret.Name)
+		if secret.OnChange != "" && c != "" {
+			hooks = append(hooks, hook{"secret", secret.Name, secret.Path, c, secret.OnChange})
+		}
+	}
+	for _, template := range templates {
+		c := change(changes.newTemplates, changes.modifiedTemplates, template.Name)
+		if template.OnChange != "" && c != "" {
+			hooks = append(hooks, hook{"template", template.Name, template.Path, c, template.OnChange})
+		}
+	}
+	return hooks
+}
+
+// runHooks runs the onChange commands one after another. A failing command
+// does not stop the remaining ones, all failures are returned together.
+func runHooks(isDry bool, logcfg loggingConfig, hooks []hook, timeout time.Duration) error {
+	var errs []error
+	for _, h := range hooks {
+		if isDry {
+			logcfg.emit(event{Event: EventOnChangeRun, Name: h.name, Path: h.path, Dry: true})
+			if !logcfg.jsonOutput() {
+				fmt.Fprintf(os.Stderr, "would run %s\n", h)
+			}
+			continue
+		}
+		err := runHook(h, timeout)
+		e := event{Event: EventOnChangeRun, Name: h.name, Path: h.path}
+		if err != nil {
+			e.Error = err.Error()
+			errs = append(errs, fmt.Errorf("%s: %w", h, err))
+		}
+		logcfg.emit(e)
+		if !logcfg.jsonOutput() && logcfg.SecretChanges && err == nil {
+			fmt.Printf("ran %s\n", h)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func runHook(h hook, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", h.command)
+	cmd.Env = append(os.Environ(),
+		"SOPS_NIX_NAME="+h.name,
+		"SOPS_NIX_PATH="+h.path,
+		"SOPS_NIX_CHANGE="+h.change,
+	)
+	// Kill the whole process group on timeout, so that children of the
+	// shell do not outlive the command.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// stdout is reserved for our own output.
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	return err
+}
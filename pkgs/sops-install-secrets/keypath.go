@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Key paths address values in yaml and json files:
+//
+//	nested/key        map keys are separated by /
+//	url\/with\/slash  \/ and \\ escape a slash and a backslash, \[ a bracket
+//	list/0, list[0]   list elements are selected by index
+//	map["a/b"]        quoted keys may contain any character, \" and \\ are escapes
+type keySegment struct {
+	name    string
+	index   int
+	isIndex bool
+	// end is the offset in the key path after this segment, used to quote
+	// the key in error messages the way the user wrote it.
+	end int
+}
+
+func parseKeyPath(keyPath string) ([]keySegment, error) {
+	var segments []keySegment
+	i := 0
+	// expectSegment is true at the start and after a '/'
+	expectSegment := true
+	for i < len(keyPath) {
+		switch {
+		case keyPath[i] == '[':
+			seg, next, err := parseBracketSegment(keyPath, i)
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, seg)
+			i = next
+			expectSegment = false
+		case keyPath[i] == '/':
+			if expectSegment {
+				return nil, fmt.Errorf("invalid key '%s': empty key at position %d", keyPath, i)
+			}
+			i++
+			expectSegment = true
+			if i == len(keyPath) {
+				return nil, fmt.Errorf("invalid key '%s': empty key at the end", keyPath)
+			}
+		default:
+			if !expectSegment {
+				return nil, fmt.Errorf("invalid key '%s': expected '/' or '[' at position %d", keyPath, i)
+			}
+			var name strings.Builder
+			for i < len(keyPath) && keyPath[i] != '/' && keyPath[i] != '[' {
+				if keyPath[i] == '\\' {
+					if i+1 == len(keyPath) {
+						return nil, fmt.Errorf("invalid key '%s': trailing backslash", keyPath)
+					}
+					switch keyPath[i+1] {
+					case '/', '\\', '[':
+					default:
+						return nil, fmt.Errorf("invalid key '%s': unknown escape sequence '\\%c' at position %d", keyPath, keyPath[i+1], i)
+					}
+					i++
+				}
+				name.WriteByte(keyPath[i])
+				i++
+			}
+			segments = append(segments, keySegment{name: name.String(), end: i})
+			expectSegment = false
+		}
+	}
+	if len(segments) == 0 {
+		return nil, errors.New("empty key")
+	}
+	return segments, nil
+}
+
+// parseBracketSegment parses `[N]` or `["quoted"]` starting at keyPath[start].
+func parseBracketSegment(keyPath string, start int) (keySegment, int, error) {
+	i := start + 1
+	if i < len(keyPath) && keyPath[i] == '"' {
+		var name strings.Builder
+		i++
+		for {
+			if i >= len(keyPath) {
+				return keySegment{}, 0, fmt.Errorf("invalid key '%s': unterminated quote at position %d", keyPath, start)
+			}
+			c := keyPath[i]
+			if c == '"' {
+				break
+			}
+			if c == '\\' {
+				if i+1 == len(keyPath) || (keyPath[i+1] != '"' && keyPath[i+1] != '\\') {
+					return keySegment{}, 0, fmt.Errorf("invalid key '%s': invalid escape sequence in quoted key at position %d", keyPath, i)
+				}
+				i++
+				c = keyPath[i]
+			}
+			name.WriteByte(c)
+			i++
+		}
+		i++
+		if i >= len(keyPath) || keyPath[i] != ']' {
+			return keySegment{}, 0, fmt.Errorf("invalid key '%s': expected ']' at position %d", keyPath, i)
+		}
+		return keySegment{name: name.String(), end: i + 1}, i + 1, nil
+	}
+
+	closing := strings.IndexByte(keyPath[i:], ']')
+	if closing == -1 {
+		return keySegment{}, 0, fmt.Errorf("invalid key '%s': unterminated '[' at position %d", keyPath, start)
+	}
+	indexStr := keyPath[i : i+closing]
+	index, err := strconv.Atoi(indexStr)
+	if err != nil || index < 0 {
+		return keySegment{}, 0, fmt.Errorf("invalid key '%s': '%s' is not a valid list index", keyPath, indexStr)
+	}
+	end := i + closing + 1
+	return keySegment{index: index, isIndex: true, end: end}, end, nil
+}
+
+func recurseSecretKey(keys map[string]interface{}, wantedKey string) (interface{}, error) {
+	segments, err := parseKeyPath(wantedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var current interface{} = keys
+	parentKey := ""
+	for _, seg := range segments {
+		keyUntilNow := wantedKey[:seg.end]
+		switch data := current.(type) {
+		case map[string]interface{}, map[interface{}]interface{}:
+			if seg.isIndex {
+				return nil, fmt.Errorf("%s refers to a dictionary, not a list", describeKey(parentKey))
+			}
+			val, ok, err := lookupMapKey(data, seg.name)
+			if err != nil {
+				return nil, fmt.Errorf("the key '%s' is ambiguous: %w", keyUntilNow, err)
+			}
+			if !ok {
+				return nil, fmt.Errorf("the key '%s' cannot be found", keyUntilNow)
+			}
+			current = val
+		case []interface{}:
+			index := seg.index
+			if !seg.isIndex {
+				index, err = strconv.Atoi(seg.name)
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("%s refers to a list, '%s' is not a valid list index", describeKey(parentKey), seg.name)
+				}
+			}
+			if index >= len(data) {
+				return nil, fmt.Errorf("index %d of %s is out of range, the list has %d elements", index, describeKey(parentKey), len(data))
+			}
+			current = data[index]
+		default:
+			return nil, fmt.Errorf("key '%s' does not refer to a dictionary or list", parentKey)
+		}
+		parentKey = keyUntilNow
+	}
+	return current, nil
+}
+
+func describeKey(key string) string {
+	if key == "" {
+		return "the top level"
+	}
+	return fmt.Sprintf("key '%s'", key)
+}
+
+// lookupMapKey finds key in maps decoded from json or yaml. Yaml keys may be
+// numbers or booleans, so they are compared by their string form. Keys that
+// only differ in their type, like 1 and "1", cannot be told apart this way and
+// are reported as an error.
+func lookupMapKey(data interface{}, key string) (interface{}, bool, error) {
+	switch m := data.(type) {
+	case map[string]interface{}:
+		val, ok := m[key]
+		return val, ok, nil
+	case map[interface{}]interface{}:
+		var (
+			found   interface{}
+			matches []string
+		)
+		for k, val := range m {
+			if fmt.Sprint(k) == key {
+				found = val
+				matches = append(matches, fmt.Sprintf("%#v", k))
+			}
+		}
+		if len(matches) > 1 {
+			sort.Strings(matches)
+			return nil, false, fmt.Errorf("it matches the keys %s", strings.Join(matches, ", "))
+		}
+		return found, len(matches) == 1, nil
+	}
+	return nil, false, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type DeliveryType string
+
+const (
+	FileDelivery    DeliveryType = "file"
+	KeyringDelivery DeliveryType = "keyring"
+	BrokerDelivery  DeliveryType = "broker"
+)
+
+func (d *DeliveryType) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	switch t := DeliveryType(s); t {
+	case "":
+		*d = FileDelivery
+	case FileDelivery, KeyringDelivery, BrokerDelivery:
+		*d = t
+	default:
+		return fmt.Errorf("unknown delivery '%s'", s)
+	}
+	return nil
+}
+
+// Permissions of kernel keys, see keyctl_setperm(3).
+const (
+	keyPosAll    = 0x3f000000
+	keyUsrView   = 0x00010000
+	keyUsrRead   = 0x00020000
+	keyUsrSearch = 0x00080000
+	keyUsrAll    = 0x003f0000
+	keyGrpView   = 0x00000100
+	keyGrpRead   = 0x00000200
+	keyGrpSearch = 0x00000800
+	keyOthView   = 0x00000001
+	keyOthRead   = 0x00000002
+	keyOthSearch = 0x00000008
+)
+
+// keyDescriptionPrefix is prepended to the secret name to form the
+// description of its key.
+const keyDescriptionPrefix = "sops-nix:"
+
+// kernelKeyringName returns the name of the keyring that holds the keys of a
+// manifest, so that the secrets for users and the regular secrets do not
+// revoke each other's keys.
+func kernelKeyringName(symlinkPath string) string {
+	return "sops-nix:" + filepath.Base(symlinkPath)
+}
+
+// keyPermissions maps the read bits of a file mode to the permissions of a
+// key. The possessor, which is sops-install-secrets itself, may do anything.
+func keyPermissions(mode os.FileMode) uint32 {
+	perm := uint32(keyPosAll)
+	if mode&0o400 != 0 {
+		perm |= keyUsrView | keyUsrRead | keyUsrSearch
+	}
+	if mode&0o040 != 0 {
+		perm |= keyGrpView | keyGrpRead | keyGrpSearch
+	}
+	if mode&0o004 != 0 {
+		perm |= keyOthView | keyOthRead | keyOthSearch
+	}
+	return perm
+}
+
+// fileSecrets returns the secrets that are written to the secrets
+// directory.
+func fileSecrets(secrets []secret) []secret {
+	var files []secret
+	for _, secret := range secrets {
+		if secret.Delivery != KeyringDelivery && secret.Delivery != BrokerDelivery {
+			files = append(files, secret)
+		}
+	}
+	return files
+}
+
+// currentKeyValue returns the value of the key of s, if it exists.
+func currentKeyValue(s *secret) ([]byte, bool, error) {
+	keyring, err := findKernelKeyring(s.keyring)
+	if err != nil || keyring == 0 {
+		return nil, false, err
+	}
+	return readKernelKey(keyring, keyDescriptionPrefix+s.Name)
+}
+
+// changedKey compares the key of a secret with its new value.
+func changedKey(s *secret) (isNew bool, isModified bool, err error) {
+	value, found, err := currentKeyValue(s)
+	if err != nil {
+		return false, false, fmt.Errorf("cannot read key of secret '%s': %w", s.Name, err)
+	}
+	if !found {
+		return true, false, nil
+	}
+	return false, !bytes.Equal(value, s.value), nil
+}
+
+// updateKernelKeyring loads the secrets delivered by keyring into the
+// keyring named keyringName. Existing keys are updated in place, so their
+// ids stay the same. Keys of secrets that are no longer delivered by keyring
+// are revoked.
+func updateKernelKeyring(logcfg loggingConfig, keyringName string, secrets []secret) error {
+	var wanted []secret
+	for _, secret := range secrets {
+		if secret.Delivery == KeyringDelivery {
+			wanted = append(wanted, secret)
+		}
+	}
+
+	keyring, err := findKernelKeyring(keyringName)
+	if err != nil {
+		return err
+	}
+	if keyring == 0 {
+		if len(wanted) == 0 {
+			return nil
+		}
+		if keyring, err = createKernelKeyring(keyringName, keyPosAll|keyUsrAll|keyOthView|keyOthSearch); err != nil {
+			return fmt.Errorf("cannot create keyring %s: %w", keyringName, err)
+		}
+	}
+
+	keep := make(map[string]bool, len(wanted))
+	for _, secret := range wanted {
+		description := keyDescriptionPrefix + secret.Name
+		keep[description] = true
+		if _, err := setKernelKey(keyring, description, secret.value, secret.owner, secret.group, keyPermissions(secret.mode)); err != nil {
+			return fmt.Errorf("cannot load secret '%s' into keyring %s: %w", secret.Name, keyringName, err)
+		}
+	}
+
+	keys, err := listKernelKeys(keyring)
+	if err != nil {
+		return fmt.Errorf("cannot list keys of keyring %s: %w", keyringName, err)
+	}
+	descriptions := make([]string, 0, len(keys))
+	for description := range keys {
+		descriptions = append(descriptions, description)
+	}
+	sort.Strings(descriptions)
+	for _, description := range descriptions {
+		if keep[description] || !strings.HasPrefix(description, keyDescriptionPrefix) {
+			continue
+		}
+		if err := revokeKernelKey(keyring, keys[description]); err != nil {
+			return fmt.Errorf("cannot revoke key %s: %w", description, err)
+		}
+		name := strings.TrimPrefix(description, keyDescriptionPrefix)
+		logcfg.emit(event{Event: EventKeyRevoked, Name: name})
+		if !logcfg.jsonOutput() && logcfg.SecretChanges {
+			fmt.Printf("revoking key of secret %s\n", name)
+		}
+	}
+	return nil
+}
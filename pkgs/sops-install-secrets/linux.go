@@ -3,9 +3,14 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/moby/sys/mountinfo"
 	"golang.org/x/sys/unix"
@@ -65,3 +70,229 @@ func MountSecretFs(mountpoint string, keysGID int, useTmpfs bool, userMode bool)
 
 	return nil
 }
+
+// watchFiles reports the paths that were written, replaced or removed. The
+// parent directories are watched instead of the files, so that files that are
+// replaced by a rename, as editors and deployment tools do, stay watched.
+func watchFiles(paths []string) (<-chan string, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("cannot initialize inotify: %w", err)
+	}
+	const mask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE | unix.IN_DELETE | unix.IN_ATTRIB
+	watched := make(map[string]bool)
+	dirs := make(map[int32]string)
+	for _, path := range paths {
+		candidates := []string{filepath.Clean(path)}
+		// Also watch the target of symlinks, e.g. in /etc.
+		if target, err := filepath.EvalSymlinks(path); err == nil && target != candidates[0] {
+			candidates = append(candidates, target)
+		}
+		for _, file := range candidates {
+			watched[file] = true
+			dir := filepath.Dir(file)
+			wd, err := unix.InotifyAddWatch(fd, dir, mask)
+			if err != nil {
+				_ = unix.Close(fd)
+				return nil, fmt.Errorf("cannot watch '%s': %w", dir, err)
+			}
+			dirs[int32(wd)] = dir
+		}
+	}
+
+	changed := make(chan string)
+	go func() {
+		defer close(changed)
+		defer func() { _ = unix.Close(fd) }()
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := unix.Read(fd, buf)
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			if err != nil || n <= 0 {
+				fmt.Fprintf(os.Stderr, "cannot read inotify events: %v\n", err)
+				return
+			}
+			for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+				wd := int32(binary.NativeEndian.Uint32(buf[offset:]))
+				nameLen := int(binary.NativeEndian.Uint32(buf[offset+12:]))
+				name := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+nameLen]
+				offset += unix.SizeofInotifyEvent + nameLen
+				if i := bytes.IndexByte(name, 0); i != -1 {
+					name = name[:i]
+				}
+				path := filepath.Join(dirs[wd], string(name))
+				if watched[path] {
+					changed <- path
+				}
+			}
+		}
+	}()
+	return changed, nil
+}
+
+// possessUserKeyring links the user keyring of root into the session
+// keyring. Keys are only possessed if they can be found from the session
+// keyring, and systemd starts system services with a private session
+// keyring by default (KeyringMode=private). Without possession, the
+// permissions of the keyring and of keys owned by other users cannot be
+// changed and their values cannot be read.
+func possessUserKeyring() error {
+	if _, err := unix.KeyctlInt(unix.KEYCTL_LINK, unix.KEY_SPEC_USER_KEYRING, unix.KEY_SPEC_SESSION_KEYRING, 0, 0); err != nil {
+		return fmt.Errorf("cannot link user keyring into session keyring: %w", err)
+	}
+	return nil
+}
+
+// findKernelKeyring returns the id of the named keyring linked into the user
+// keyring of root, or 0 if it does not exist yet.
+func findKernelKeyring(name string) (int, error) {
+	if err := possessUserKeyring(); err != nil {
+		return 0, err
+	}
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "keyring", name, 0)
+	if errors.Is(err, unix.ENOKEY) || errors.Is(err, unix.EKEYREVOKED) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot search keyring %s: %w", name, err)
+	}
+	return id, nil
+}
+
+// createKernelKeyring links a new keyring into the user keyring of root,
+// which lives as long as any process of root runs.
+func createKernelKeyring(name string, perm uint32) (int, error) {
+	id, err := unix.AddKey("keyring", name, nil, unix.KEY_SPEC_USER_KEYRING)
+	if err != nil {
+		return 0, err
+	}
+	if err := unix.KeyctlSetperm(id, perm); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func readKernelKey(keyring int, description string) ([]byte, bool, error) {
+	id, err := unix.KeyctlSearch(keyring, "user", description, 0)
+	if errors.Is(err, unix.ENOKEY) || errors.Is(err, unix.EKEYREVOKED) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	buf := make([]byte, size)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	return buf[:min(n, size)], true, nil
+}
+
+// setKernelKey adds a user key to keyring, or updates the key with the same
+// description in place.
+func setKernelKey(keyring int, description string, value []byte, uid, gid int, perm uint32) (int, error) {
+	id, err := unix.AddKey("user", description, value, keyring)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := unix.KeyctlInt(unix.KEYCTL_CHOWN, id, uid, gid, 0); err != nil {
+		return 0, fmt.Errorf("cannot change owner/group to %d/%d: %w", uid, gid, err)
+	}
+	if err := unix.KeyctlSetperm(id, perm); err != nil {
+		return 0, fmt.Errorf("cannot set permissions: %w", err)
+	}
+	return id, nil
+}
+
+// listKernelKeys returns the user keys of keyring by description.
+func listKernelKeys(keyring int) (map[string]int, error) {
+	size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, keyring, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, keyring, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]int)
+	for offset := 0; offset+4 <= min(n, size); offset += 4 {
+		id := int(int32(binary.NativeEndian.Uint32(buf[offset:])))
+		// type;uid;gid;perm;description
+		desc, err := unix.KeyctlString(unix.KEYCTL_DESCRIBE, id)
+		if err != nil {
+			// Revoked keys may disappear in between.
+			continue
+		}
+		fields := strings.SplitN(desc, ";", 5)
+		if len(fields) == 5 && fields[0] == "user" {
+			keys[fields[4]] = id
+		}
+	}
+	return keys, nil
+}
+
+func revokeKernelKey(keyring int, id int) error {
+	if _, err := unix.KeyctlInt(unix.KEYCTL_REVOKE, id, 0, 0, 0); err != nil {
+		return err
+	}
+	_, err := unix.KeyctlInt(unix.KEYCTL_UNLINK, id, keyring, 0, 0)
+	return err
+}
+
+// soPeerPidfd is SO_PEERPIDFD, supported since Linux 6.5.
+const soPeerPidfd = 77
+
+// peerCredentials returns the process that connected to conn. The uid and
+// gid are recorded by the kernel at connect time. The supplementary groups
+// and the unit are read from /proc, which is only trusted if a pidfd shows
+// that the process is still alive afterwards; otherwise its pid may have
+// been reused. Older kernels without SO_PEERPIDFD only get uid and gid.
+func peerCredentials(conn *net.UnixConn) (*peer, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *unix.Ucred
+	var credErr, pidfdErr error
+	pidfd := -1
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+		pidfd, pidfdErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, soPeerPidfd)
+	}); err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	p := &peer{PID: int(cred.Pid), UID: int(cred.Uid), GID: int(cred.Gid)}
+	if pidfdErr != nil {
+		return p, nil
+	}
+	defer func() { _ = unix.Close(pidfd) }()
+
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", p.PID))
+	if err != nil {
+		return p, nil
+	}
+	groups, err := parseStatusGroups(status)
+	if err != nil {
+		return p, nil
+	}
+	cgroup, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", p.PID))
+	if err != nil {
+		return p, nil
+	}
+	if err := unix.PidfdSendSignal(pidfd, 0, nil, 0); err != nil {
+		return p, nil
+	}
+	p.Groups = groups
+	p.Unit = cgroupUnit(cgroup)
+	return p, nil
+}
@@ -0,0 +1,142 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// readKeyAs looks up the id of the key with description in /proc/keys and
+// reads it with the credentials of uid and gid, like a service running as
+// the owner of the secret would.
+func readKeyAs(uid, gid int, description string) ([]byte, error) {
+	type result struct {
+		value []byte
+		err   error
+	}
+	done := make(chan result)
+	go func() {
+		// The thread is never unlocked, so it exits together with this
+		// goroutine instead of running others with the changed credentials.
+		runtime.LockOSThread()
+		read := func() ([]byte, error) {
+			// The raw syscalls only change the credentials of this thread.
+			if _, _, errno := unix.RawSyscall(unix.SYS_SETGROUPS, 0, 0, 0); errno != 0 {
+				return nil, fmt.Errorf("setgroups: %w", errno)
+			}
+			if _, _, errno := unix.RawSyscall(unix.SYS_SETRESGID, uintptr(gid), uintptr(gid), uintptr(gid)); errno != 0 {
+				return nil, fmt.Errorf("setresgid: %w", errno)
+			}
+			if _, _, errno := unix.RawSyscall(unix.SYS_SETRESUID, uintptr(uid), uintptr(uid), uintptr(uid)); errno != 0 {
+				return nil, fmt.Errorf("setresuid: %w", errno)
+			}
+			keys, err := os.ReadFile("/proc/keys")
+			if err != nil {
+				return nil, err
+			}
+			scanner := bufio.NewScanner(bytes.NewReader(keys))
+			for scanner.Scan() {
+				fields := strings.Fields(scanner.Text())
+				if len(fields) < 9 || fields[7] != "user" || fields[8] != description+":" {
+					continue
+				}
+				id, err := strconv.ParseInt(fields[0], 16, 32)
+				if err != nil {
+					return nil, err
+				}
+				size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, int(id), nil, 0)
+				if err != nil {
+					return nil, fmt.Errorf("cannot read key %s: %w", fields[0], err)
+				}
+				buf := make([]byte, size)
+				n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, int(id), buf, 0)
+				if err != nil {
+					return nil, fmt.Errorf("cannot read key %s: %w", fields[0], err)
+				}
+				return buf[:n], nil
+			}
+			return nil, fmt.Errorf("key %s is not visible in /proc/keys", description)
+		}
+		value, err := read()
+		done <- result{value, err}
+	}()
+	r := <-done
+	return r.value, r.err
+}
+
+func TestKernelKeyringOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner of keys requires root")
+	}
+	keyringName := kernelKeyringName(fmt.Sprintf("/run/sops-nix-test-owner-%d", os.Getpid()))
+	defer func() {
+		if keyring, err := findKernelKeyring(keyringName); err == nil && keyring != 0 {
+			_ = revokeKernelKey(unix.KEY_SPEC_USER_KEYRING, keyring)
+		}
+	}()
+
+	const owner, other = 65534, 65533
+	secrets := []secret{
+		{Name: "a", Delivery: KeyringDelivery, value: []byte("v1"), mode: 0o400, owner: owner, group: owner, keyring: keyringName},
+	}
+	ok(t, updateKernelKeyring(loggingConfig{}, keyringName, secrets))
+
+	// The keyring is linked into the user keyring of root, which the owner
+	// cannot search, but the owner can read the key by its id.
+	value, err := readKeyAs(owner, owner, "sops-nix:a")
+	ok(t, err)
+	equals(t, "v1", string(value))
+
+	_, err = readKeyAs(other, other, "sops-nix:a")
+	equals(t, true, err != nil)
+}
+
+func TestKernelKeyringPrivateSession(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner of keys requires root")
+	}
+	keyringName := kernelKeyringName(fmt.Sprintf("/run/sops-nix-test-session-%d", os.Getpid()))
+	defer func() {
+		if keyring, err := findKernelKeyring(keyringName); err == nil && keyring != 0 {
+			_ = revokeKernelKey(unix.KEY_SPEC_USER_KEYRING, keyring)
+		}
+	}()
+
+	// systemd gives system services a private session keyring that the
+	// user keyring of root is not linked into, see KeyringMode=.
+	// Credentials are per thread, so the session keyring is only joined by
+	// a thread that exits afterwards.
+	done := make(chan error)
+	go func() {
+		runtime.LockOSThread()
+		done <- func() error {
+			if _, err := unix.KeyctlJoinSessionKeyring(fmt.Sprintf("sops-nix-test-%d", os.Getpid())); err != nil {
+				return fmt.Errorf("cannot join session keyring: %w", err)
+			}
+			secrets := []secret{
+				{Name: "a", Delivery: KeyringDelivery, value: []byte("v1"), mode: 0o400, owner: 65534, group: 65534, keyring: keyringName},
+			}
+			if err := updateKernelKeyring(loggingConfig{}, keyringName, secrets); err != nil {
+				return err
+			}
+			value, found, err := currentKeyValue(&secrets[0])
+			if err != nil {
+				return err
+			}
+			if !found || string(value) != "v1" {
+				return fmt.Errorf("unexpected key value %q", value)
+			}
+			return nil
+		}()
+	}()
+	ok(t, <-done)
+}
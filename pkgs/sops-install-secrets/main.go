@@ -8,87 +8,152 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"os/exec"
 	"os/user"
 	"path"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	gotemplate "text/template"
 	"time"
 
 	"github.com/Mic92/sops-nix/pkgs/sops-install-secrets/sshkeys"
 	agessh "github.com/Mic92/ssh-to-age"
 
-	"github.com/getsops/sops/v3/decrypt"
+	"github.com/getsops/sops/v3/stores/dotenv"
 	"github.com/joho/godotenv"
 	"github.com/mozilla-services/yaml"
+	"golang.org/x/crypto/ssh"
 	"gopkg.in/ini.v1"
 )
 
 type secret struct {
-	Name         string     `json:"name"`
-	Key          string     `json:"key"`
-	Path         string     `json:"path"`
-	Owner        *string    `json:"owner,omitempty"`
-	UID          int        `json:"uid"`
-	Group        *string    `json:"group,omitempty"`
-	GID          int        `json:"gid"`
-	SopsFile     string     `json:"sopsFile"`
-	Format       FormatType `json:"format"`
-	Mode         string     `json:"mode"`
-	RestartUnits []string   `json:"restartUnits"`
-	ReloadUnits  []string   `json:"reloadUnits"`
-	value        []byte
-	mode         os.FileMode
-	owner        int
-	group        int
+	Name     string     `json:"name"`
+	Key      string     `json:"key"`
+	Path     string     `json:"path"`
+	Owner    *string    `json:"owner,omitempty"`
+	UID      int        `json:"uid"`
+	Group    *string    `json:"group,omitempty"`
+	GID      int        `json:"gid"`
+	SopsFile string     `json:"sopsFile"`
+	Format   FormatType `json:"format"`
+	// ValueFormat is used to serialize maps and lists selected by Key.
+	// Defaults to Format.
+	ValueFormat *FormatType `json:"valueFormat,omitempty"`
+	// Transforms are applied in order to the decrypted value.
+	Transforms   []TransformType `json:"transforms"`
+	Mode         string          `json:"mode"`
+	RestartUnits []string        `json:"restartUnits"`
+	ReloadUnits  []string        `json:"reloadUnits"`
+	// OnChange is run with /bin/sh after the secret was added or modified.
+	OnChange string `json:"onChange"`
+	// Delivery selects whether the secret is written to a file, loaded
+	// into the kernel keyring or served by the broker.
+	Delivery DeliveryType `json:"delivery"`
+	// BrokerUnits may fetch the secret from the broker regardless of the
+	// user and group they run as.
+	BrokerUnits []string `json:"brokerUnits"`
+	// Generate creates the value with the generate subcommand if the key
+	// is missing from the sops file.
+	Generate *generateSpec `json:"generate,omitempty"`
+	// Hashes are files with hashes of the value, keyed by the name of the
+	// option in the Nix module.
+	Hashes map[string]*passwordHash `json:"hashes"`
+	// Required secrets abort the activation if they cannot be decrypted,
+	// regardless of the decryption failure policy.
+	Required bool `json:"required"`
+	value    []byte
+	mode     os.FileMode
+	owner    int
+	group    int
+	// sourceSHA256, keyType and carriedForward are recorded in the
+	// generation metadata.
+	sourceSHA256   string
+	keyType        string
+	carriedForward bool
+	// skipped is set if the secret could not be decrypted and is not
+	// installed. Templates referring to it cannot be rendered.
+	skipped bool
+	// keyring is the name of the kernel keyring for secrets delivered by
+	// keyring.
+	keyring string
+}
+
+// sshKeyPassphrase points at the passphrase of an encrypted ssh key. Exactly
+// one of File and Credential is set; Credential is the name of a systemd
+// credential looked up in $CREDENTIALS_DIRECTORY.
+type sshKeyPassphrase struct {
+	File       string `json:"file"`
+	Credential string `json:"credential"`
 }
 
 type loggingConfig struct {
 	KeyImport     bool `json:"keyImport"`
 	SecretChanges bool `json:"secretChanges"`
+	// events is set with -output=json
+	events *json.Encoder
 }
 
 type template struct {
-	Name         string   `json:"name"`
-	Content      string   `json:"content"`
-	Path         string   `json:"path"`
-	Mode         string   `json:"mode"`
-	Owner        *string  `json:"owner,omitempty"`
-	UID          int      `json:"uid"`
-	Group        *string  `json:"group,omitempty"`
-	GID          int      `json:"gid"`
-	File         string   `json:"file"`
-	RestartUnits []string `json:"restartUnits"`
-	ReloadUnits  []string `json:"reloadUnits"`
+	Name         string         `json:"name"`
+	Content      string         `json:"content"`
+	Path         string         `json:"path"`
+	Mode         string         `json:"mode"`
+	Owner        *string        `json:"owner,omitempty"`
+	UID          int            `json:"uid"`
+	Group        *string        `json:"group,omitempty"`
+	GID          int            `json:"gid"`
+	File         string         `json:"file"`
+	Engine       TemplateEngine `json:"engine"`
+	RestartUnits []string       `json:"restartUnits"`
+	ReloadUnits  []string       `json:"reloadUnits"`
+	OnChange     string         `json:"onChange"`
 	value        []byte
 	mode         os.FileMode
 	content      string
+	goTemplate   *gotemplate.Template
 	owner        int
 	group        int
 }
 
 type manifest struct {
-	Secrets                 []secret          `json:"secrets"`
-	Templates               []template        `json:"templates"`
-	PlaceholderBySecretName map[string]string `json:"placeholderBySecretName"`
-	SecretsMountPoint       string            `json:"secretsMountPoint"`
-	SymlinkPath             string            `json:"symlinkPath"`
-	KeepGenerations         int               `json:"keepGenerations"`
-	SSHKeyPaths             []string          `json:"sshKeyPaths"`
-	GnupgHome               string            `json:"gnupgHome"`
-	AgeKeyFile              string            `json:"ageKeyFile"`
-	AgeSSHKeyPaths          []string          `json:"ageSshKeyPaths"`
-	UseTmpfs                bool              `json:"useTmpfs"`
-	UserMode                bool              `json:"userMode"`
-	Logging                 loggingConfig     `json:"logging"`
+	Secrets                 []secret                    `json:"secrets"`
+	Templates               []template                  `json:"templates"`
+	PlaceholderBySecretName map[string]string           `json:"placeholderBySecretName"`
+	SecretsMountPoint       string                      `json:"secretsMountPoint"`
+	SymlinkPath             string                      `json:"symlinkPath"`
+	KeepGenerations         int                         `json:"keepGenerations"`
+	MaxGenerationAge        string                      `json:"maxGenerationAge"`
+	MaxGenerationsBytes     int64                       `json:"maxGenerationsBytes"`
+	DecryptionWorkers       int                         `json:"decryptionWorkers"`
+	DecryptionFailurePolicy DecryptionFailurePolicy     `json:"decryptionFailurePolicy"`
+	SystemdUnits            []string                    `json:"systemdUnits"`
+	UnknownUnits            UnknownUnitsPolicy          `json:"unknownUnits"`
+	MaxSopsFileAge          string                      `json:"maxSopsFileAge"`
+	ExpiredSopsFiles        ExpiredSopsFilesPolicy      `json:"expiredSopsFiles"`
+	UnitJobTimeout          string                      `json:"unitJobTimeout"`
+	OnChangeTimeout         string                      `json:"onChangeTimeout"`
+	SSHKeyPaths             []string                    `json:"sshKeyPaths"`
+	GnupgHome               string                      `json:"gnupgHome"`
+	AgeKeyFile              string                      `json:"ageKeyFile"`
+	AgeSSHKeyPaths          []string                    `json:"ageSshKeyPaths"`
+	SSHKeyPassphrases       map[string]sshKeyPassphrase `json:"sshKeyPassphrases"`
+	UseTmpfs                bool                        `json:"useTmpfs"`
+	UserMode                bool                        `json:"userMode"`
+	Logging                 loggingConfig               `json:"logging"`
+	maxGenerationAge        time.Duration
+	unitJobTimeout          time.Duration
+	onChangeTimeout         time.Duration
+	maxSopsFileAge          time.Duration
 }
 
 type secretFile struct {
 	cipherText []byte
 	keys       map[string]interface{}
+	ini        *ini.File
 	/// First secret that defined this secretFile, used for error messages
 	firstSecret *secret
 }
@@ -101,6 +166,8 @@ const (
 	Binary FormatType = "binary"
 	Dotenv FormatType = "dotenv"
 	Ini    FormatType = "ini"
+	Age    FormatType = "age"
+	PGP    FormatType = "pgp"
 )
 
 func IsValidFormat(format string) bool {
@@ -109,7 +176,9 @@ func IsValidFormat(format string) bool {
 		string(JSON),
 		string(Binary),
 		string(Dotenv),
-		string(Ini):
+		string(Ini),
+		string(Age),
+		string(PGP):
 		return true
 	default:
 		return false
@@ -125,7 +194,7 @@ func (f *FormatType) UnmarshalJSON(b []byte) error {
 	switch t {
 	case "":
 		*f = Yaml
-	case Yaml, JSON, Binary, Dotenv, Ini:
+	case Yaml, JSON, Binary, Dotenv, Ini, Age, PGP:
 		*f = t
 	}
 
@@ -148,14 +217,50 @@ type options struct {
 	checkMode    CheckMode
 	manifest     string
 	ignorePasswd bool
+	output       OutputFormat
+	// command is empty when installing secrets, otherwise one of the
+	// subcommands. generations are its numeric arguments.
+	command     Command
+	generations []int
+	// watch keeps running and installs a new generation whenever a sops
+	// file or template file changes.
+	watch         bool
+	watchDebounce time.Duration
+	// socket is the socket of the broker for serve and get. get writes the
+	// secret secretName to fd, or to stdout if fd is negative.
+	socket     string
+	secretName string
+	fd         int
+	// sourceRoot is where generate looks for sops files that were copied
+	// into the Nix store.
+	sourceRoot string
+	// systemdUnits is the unit directory of the system that is built,
+	// restartUnits and reloadUnits are checked against it.
+	systemdUnits string
 }
 
+type Command string
+
+const (
+	Rollback        Command = "rollback"
+	ListGenerations Command = "list-generations"
+	DiffGenerations Command = "diff-generations"
+	Serve           Command = "serve"
+	Get             Command = "get"
+	Generate        Command = "generate"
+)
+
 type appContext struct {
 	manifest            manifest
 	secretFiles         map[string]secretFile
 	secretByPlaceholder map[string]*secret
-	checkMode           CheckMode
-	ignorePasswd        bool
+	// missingKeys are the keys of secrets with a generate spec that are not
+	// in their sops files yet.
+	missingKeys  []string
+	checkMode    CheckMode
+	ignorePasswd bool
+	// systemdUnitsDir is the unit directory of the system that is built.
+	systemdUnitsDir string
 }
 
 // Keep this in sync with `modules/sops/templates/default.nix`
@@ -284,118 +389,391 @@ func symlinkSecretsAndTemplates(targetDir string, secrets []secret, templates []
 }
 
 type plainData struct {
-	data   map[string]interface{}
-	binary []byte
+	data    map[string]interface{}
+	ini     *ini.File
+	binary  []byte
+	sha256  string
+	keyType string
 }
 
-func recurseSecretKey(keys map[string]interface{}, wantedKey string) (string, error) {
-	var val interface{}
-	var ok bool
-	currentKey := wantedKey
-	currentData := keys
-	keyUntilNow := ""
+func dotenvSecretKey(env map[string]interface{}, wantedKey string) (string, error) {
+	val, ok := env[wantedKey]
+	if !ok {
+		return "", fmt.Errorf("the key '%s' cannot be found", wantedKey)
+	}
+	return val.(string), nil
+}
 
-	for {
-		slashIndex := strings.IndexByte(currentKey, '/')
-		if slashIndex == -1 {
-			// We got to the end
-			val, ok = currentData[currentKey]
-			if !ok {
-				if keyUntilNow != "" {
-					keyUntilNow += "/"
-				}
-				return "", fmt.Errorf("the key '%s%s' cannot be found", keyUntilNow, currentKey)
+// iniSecretKey looks up `section/key`. Keys without a section are looked up in
+// the default section.
+func iniSecretKey(file *ini.File, wantedKey string) (string, error) {
+	sectionName, keyName := ini.DefaultSection, wantedKey
+	if slashIndex := strings.LastIndexByte(wantedKey, '/'); slashIndex != -1 {
+		sectionName, keyName = wantedKey[:slashIndex], wantedKey[slashIndex+1:]
+	}
+	section, err := file.GetSection(sectionName)
+	if err != nil {
+		return "", fmt.Errorf("the section '%s' cannot be found", sectionName)
+	}
+	key, err := section.GetKey(keyName)
+	if err != nil {
+		return "", fmt.Errorf("the key '%s' cannot be found in section '%s'", keyName, sectionName)
+	}
+	return key.Value(), nil
+}
+
+// parseDotenv parses decrypted dotenv files. sops writes values unquoted with
+// escaped newlines, so its own parser is used instead of godotenv.
+func parseDotenv(plain []byte) (map[string]interface{}, error) {
+	branches, err := (&dotenv.Store{}).LoadPlainFile(plain)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]interface{})
+	for _, branch := range branches {
+		for _, item := range branch {
+			if key, ok := item.Key.(string); ok {
+				keys[key] = item.Value
 			}
-			break
-		}
-		thisKey := currentKey[:slashIndex]
-		if keyUntilNow == "" {
-			keyUntilNow = thisKey
-		} else {
-			keyUntilNow += "/" + thisKey
-		}
-		currentKey = currentKey[(slashIndex + 1):]
-		val, ok = currentData[thisKey]
-		if !ok {
-			return "", fmt.Errorf("the key '%s' cannot be found", keyUntilNow)
 		}
-		var valWithWrongType map[interface{}]interface{}
-		valWithWrongType, ok = val.(map[interface{}]interface{})
-		if !ok {
-			return "", fmt.Errorf("key '%s' does not refer to a dictionary", keyUntilNow)
+	}
+	return keys, nil
+}
+
+func parseIni(content []byte) (*ini.File, error) {
+	return ini.LoadSources(ini.LoadOptions{AllowNonUniqueSections: true}, content)
+}
+
+// secretValue converts the value found at a key to the content of the secret.
+// Scalars are written in their canonical text form, maps and lists are
+// serialized as valueFormat.
+func secretValue(val interface{}, valueFormat FormatType) ([]byte, error) {
+	switch v := val.(type) {
+	case string:
+		return []byte(v), nil
+	case bool:
+		return []byte(strconv.FormatBool(v)), nil
+	case int:
+		return []byte(strconv.Itoa(v)), nil
+	case int64:
+		return []byte(strconv.FormatInt(v, 10)), nil
+	case uint64:
+		return []byte(strconv.FormatUint(v, 10)), nil
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'f', -1, 64)), nil
+	case json.Number:
+		return []byte(v.String()), nil
+	case nil:
+		return nil, errors.New("the value is null")
+	case map[interface{}]interface{}, map[string]interface{}, []interface{}:
+		subtree := normalizeSubtree(val, valueFormat)
+		if valueFormat == JSON {
+			out, err := json.MarshalIndent(subtree, "", "  ")
+			if err != nil {
+				return nil, fmt.Errorf("cannot serialize value as json: %w", err)
+			}
+			return append(out, '\n'), nil
 		}
-		currentData = make(map[string]interface{})
-		for key, value := range valWithWrongType {
-			currentData[key.(string)] = value
+		out, err := yaml.Marshal(subtree)
+		if err != nil {
+			return nil, fmt.Errorf("cannot serialize value as yaml: %w", err)
 		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("values of type %T are not supported", val)
 	}
+}
 
-	strVal, ok := val.(string)
-	if !ok {
-		return "", fmt.Errorf("the value of key '%s' is not a string", keyUntilNow)
+// normalizeSubtree makes yaml maps serializable as json and turns json
+// numbers into numbers yaml understands.
+func normalizeSubtree(val interface{}, valueFormat FormatType) interface{} {
+	switch v := val.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = normalizeSubtree(value, valueFormat)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[key] = normalizeSubtree(value, valueFormat)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, value := range v {
+			l[i] = normalizeSubtree(value, valueFormat)
+		}
+		return l
+	case json.Number:
+		if valueFormat == JSON {
+			return v
+		}
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	default:
+		return v
 	}
-	return strVal, nil
 }
 
 func decryptSecret(s *secret, sourceFiles map[string]plainData) error {
-	sourceFile := sourceFiles[s.SopsFile]
-	if sourceFile.data == nil || sourceFile.binary == nil {
-		plain, err := decrypt.File(s.SopsFile, string(s.Format))
+	sourceFile, ok := sourceFiles[s.SopsFile]
+	if !ok {
+		cipherText, err := os.ReadFile(s.SopsFile)
 		if err != nil {
-			return fmt.Errorf("failed to decrypt '%s': %w", s.SopsFile, err)
+			return fmt.Errorf("failed to read '%s': %w", s.SopsFile, err)
 		}
-
+		var plain []byte
+		keyType := string(s.Format)
 		switch s.Format {
-		case Binary, Dotenv, Ini:
-			sourceFile.binary = plain
-		case Yaml:
-			if s.Key == "" {
-				sourceFile.binary = plain
-			} else {
-				if err := yaml.Unmarshal(plain, &sourceFile.data); err != nil {
-					return fmt.Errorf("cannot parse yaml of '%s': %w", s.SopsFile, err)
-				}
-			}
-		case JSON:
-			if s.Key == "" {
-				sourceFile.binary = plain
-			} else {
-				if err := json.Unmarshal(plain, &sourceFile.data); err != nil {
-					return fmt.Errorf("cannot parse json of '%s': %w", s.SopsFile, err)
-				}
-			}
+		case Age:
+			plain, err = decryptAgeFile(cipherText)
+		case PGP:
+			plain, err = decryptPGPFile(cipherText)
 		default:
-			return fmt.Errorf("secret of type %s in %s is not supported", s.Format, s.SopsFile)
+			plain, keyType, err = decryptSopsFile(cipherText, s.Format)
 		}
+		if err != nil {
+			return fmt.Errorf("failed to decrypt '%s': %w", s.SopsFile, err)
+		}
+		sourceFile.binary = plain
+		sourceFile.sha256 = sha256Hex(cipherText)
+		sourceFile.keyType = keyType
+		sourceFiles[s.SopsFile] = sourceFile
 	}
+	s.sourceSHA256 = sourceFile.sha256
+	s.keyType = sourceFile.keyType
 	switch s.Format {
-	case Binary, Dotenv, Ini:
+	case Binary, Age, PGP:
 		s.value = sourceFile.binary
-	case Yaml, JSON:
+	case Dotenv:
 		if s.Key == "" {
 			s.value = sourceFile.binary
-		} else {
-			strVal, err := recurseSecretKey(sourceFile.data, s.Key)
+			break
+		}
+		if sourceFile.data == nil {
+			data, err := parseDotenv(sourceFile.binary)
+			if err != nil {
+				return fmt.Errorf("cannot parse dotenv of '%s': %w", s.SopsFile, err)
+			}
+			sourceFile.data = data
+		}
+		strVal, err := dotenvSecretKey(sourceFile.data, s.Key)
+		if err != nil {
+			return fmt.Errorf("secret %s in %s is not valid: %w", s.Name, s.SopsFile, err)
+		}
+		s.value = []byte(strVal)
+	case Ini:
+		if s.Key == "" {
+			s.value = sourceFile.binary
+			break
+		}
+		if sourceFile.ini == nil {
+			file, err := parseIni(sourceFile.binary)
 			if err != nil {
-				return fmt.Errorf("secret %s in %s is not valid: %w", s.Name, s.SopsFile, err)
+				return fmt.Errorf("cannot parse ini of '%s': %w", s.SopsFile, err)
 			}
-			s.value = []byte(strVal)
+			sourceFile.ini = file
+		}
+		strVal, err := iniSecretKey(sourceFile.ini, s.Key)
+		if err != nil {
+			return fmt.Errorf("secret %s in %s is not valid: %w", s.Name, s.SopsFile, err)
+		}
+		s.value = []byte(strVal)
+	case Yaml, JSON:
+		if s.Key == "" {
+			s.value = sourceFile.binary
+			break
+		}
+		if sourceFile.data == nil {
+			if s.Format == Yaml {
+				if err := yaml.Unmarshal(sourceFile.binary, &sourceFile.data); err != nil {
+					return fmt.Errorf("cannot parse yaml of '%s': %w", s.SopsFile, err)
+				}
+			} else {
+				// Keep numbers as written instead of rounding them to float64.
+				dec := json.NewDecoder(bytes.NewReader(sourceFile.binary))
+				dec.UseNumber()
+				if err := dec.Decode(&sourceFile.data); err != nil {
+					return fmt.Errorf("cannot parse json of '%s': %w", s.SopsFile, err)
+				}
+			}
+		}
+		val, err := recurseSecretKey(sourceFile.data, s.Key)
+		if err != nil {
+			return fmt.Errorf("secret %s in %s is not valid: %w", s.Name, s.SopsFile, err)
+		}
+		valueFormat := s.Format
+		if s.ValueFormat != nil {
+			valueFormat = *s.ValueFormat
 		}
+		s.value, err = secretValue(val, valueFormat)
+		if err != nil {
+			return fmt.Errorf("secret %s in %s is not valid: key '%s': %w", s.Name, s.SopsFile, s.Key, err)
+		}
+	default:
+		return fmt.Errorf("secret of type %s in %s is not supported", s.Format, s.SopsFile)
 	}
 	sourceFiles[s.SopsFile] = sourceFile
+	value, err := applyTransforms(s.value, s.Transforms)
+	if err != nil {
+		return fmt.Errorf("secret %s in %s is not valid: %w", s.Name, s.SopsFile, err)
+	}
+	s.value = value
 	return nil
 }
 
-func decryptSecrets(secrets []secret) error {
-	sourceFiles := make(map[string]plainData)
-	for i := range secrets {
-		if err := decryptSecret(&secrets[i], sourceFiles); err != nil {
+// decryptSecrets decrypts every distinct sops file once, using up to workers
+// files in parallel. If decryption fails, the error of the first failing
+// secret in manifest order is returned regardless of scheduling.
+func decryptSecrets(secrets []secret, workers int) error {
+	for _, err := range decryptSecretsEach(secrets, workers) {
+		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// decryptSecretsEach returns the error of every secret, in manifest order.
+func decryptSecretsEach(secrets []secret, workers int) []error {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	var files []string
+	secretsByFile := make(map[string][]int)
+	for i := range secrets {
+		sopsFile := secrets[i].SopsFile
+		if _, ok := secretsByFile[sopsFile]; !ok {
+			files = append(files, sopsFile)
+		}
+		secretsByFile[sopsFile] = append(secretsByFile[sopsFile], i)
+	}
+	workers = min(workers, len(files))
+
+	// Each worker only touches the secrets of the files it picked up, so
+	// secrets and errs can be written without further locking.
+	errs := make([]error, len(secrets))
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sopsFile := range jobs {
+				sourceFiles := make(map[string]plainData)
+				indices := secretsByFile[sopsFile]
+				for n, i := range indices {
+					if err := decryptSecret(&secrets[i], sourceFiles); err != nil {
+						errs[i] = err
+						// If the file itself cannot be decrypted, none of
+						// its secrets can.
+						if _, decrypted := sourceFiles[sopsFile]; !decrypted {
+							for _, j := range indices[n+1:] {
+								errs[j] = err
+							}
+							break
+						}
+					}
+				}
+			}
+		}()
+	}
+	for _, sopsFile := range files {
+		jobs <- sopsFile
+	}
+	close(jobs)
+	wg.Wait()
+	return errs
+}
+
+type DecryptionFailurePolicy string
+
+const (
+	// AbortOnFailure fails the activation if any secret cannot be decrypted.
+	AbortOnFailure DecryptionFailurePolicy = "abort"
+	// KeepPreviousOnFailure carries secrets that are not required forward
+	// from the previous generation.
+	KeepPreviousOnFailure DecryptionFailurePolicy = "keep-previous"
+)
+
+func (p *DecryptionFailurePolicy) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	switch t := DecryptionFailurePolicy(s); t {
+	case "":
+		*p = AbortOnFailure
+	case AbortOnFailure, KeepPreviousOnFailure:
+		*p = t
+	default:
+		return fmt.Errorf("unknown decryption failure policy '%s'", s)
+	}
+	return nil
+}
+
+// carryForwardSecrets deals with secrets that failed to decrypt. Unless the
+// policy is keep-previous and the secret is not required, the first error
+// in manifest order is returned. Otherwise the file of the previous
+// generation in symlinkPath is used. Without a previous file, for example at
+// boot, the secret is left out and marked as skipped. The secrets to install
+// are returned.
+func carryForwardSecrets(logcfg loggingConfig, policy DecryptionFailurePolicy, symlinkPath string, secrets []secret, errs []error) ([]secret, error) {
+	installed := make([]secret, 0, len(secrets))
+	for i := range secrets {
+		secret := &secrets[i]
+		err := errs[i]
+		if err == nil {
+			installed = append(installed, *secret)
+			continue
+		}
+		if policy != KeepPreviousOnFailure || secret.Required {
+			return nil, err
+		}
+
+		var previous []byte
+		var readErr error
+		if secret.Delivery == KeyringDelivery {
+			var found bool
+			previous, found, readErr = currentKeyValue(secret)
+			if readErr == nil && !found {
+				readErr = os.ErrNotExist
+			}
+		} else {
+			previous, readErr = os.ReadFile(filepath.Join(symlinkPath, secret.Name))
+		}
+		if readErr != nil && !os.IsNotExist(readErr) {
+			return nil, fmt.Errorf("%w (cannot read previous version of secret %s: %s)", err, secret.Name, readErr)
+		}
+		if readErr == nil {
+			secret.value = previous
+			secret.carriedForward = true
+			installed = append(installed, *secret)
+			if logcfg.jsonOutput() {
+				logcfg.emit(event{Event: EventSecretCarriedForward, Name: secret.Name, Error: err.Error()})
+			} else {
+				fmt.Fprintf(os.Stderr, "WARNING: keeping the previous version of secret %s, it cannot be decrypted: %s\n", secret.Name, err)
+			}
+		} else {
+			secret.skipped = true
+			if logcfg.jsonOutput() {
+				logcfg.emit(event{Event: EventSecretSkipped, Name: secret.Name, Error: err.Error()})
+			} else {
+				fmt.Fprintf(os.Stderr, "WARNING: not installing secret %s, it cannot be decrypted and there is no previous version: %s\n", secret.Name, err)
+			}
+		}
+	}
+	return installed, nil
+}
+
 const (
 	RamfsMagic int32 = -2054924042
 	TmpfsMagic int32 = 16914836
@@ -421,6 +799,13 @@ func prepareSecretsDir(secretMountpoint string, linkName string, keysGID int, us
 			return nil, fmt.Errorf("cannot remove %s: %w", linkName, err)
 		}
 	}
+	// After a rollback, newer generations than the current one may still
+	// exist. Never reuse their numbers.
+	if generations, err := listGenerations(secretMountpoint); err == nil && len(generations) > 0 {
+		if newest := uint64(generations[len(generations)-1]); newest > generation {
+			generation = newest
+		}
+	}
 	generation++
 	dir := filepath.Join(secretMountpoint, strconv.Itoa(int(generation)))
 	if _, err := os.Stat(dir); !os.IsNotExist(err) {
@@ -510,6 +895,7 @@ func (app *appContext) loadSopsFile(s *secret) (*secretFile, error) {
 	}
 
 	var keys map[string]interface{}
+	var iniFile *ini.File
 
 	switch s.Format {
 	case Binary:
@@ -535,16 +921,26 @@ func (app *appContext) loadSopsFile(s *secret) (*secretFile, error) {
 			return nil, fmt.Errorf("cannot parse json of '%s': %w", s.SopsFile, err)
 		}
 	case Ini:
-		_, err := ini.Load(bytes.NewReader(cipherText))
+		iniFile, err = parseIni(cipherText)
 		if err != nil {
 			return nil, fmt.Errorf("cannot parse ini of '%s': %w", s.SopsFile, err)
 		}
-		// TODO: we do not actually check the contents of the ini here...
+	case Age:
+		if err := validateAgeFile(cipherText); err != nil {
+			return nil, fmt.Errorf("'%s' is not an age encrypted file: %w", s.SopsFile, err)
+		}
+		return &secretFile{cipherText: cipherText, firstSecret: s}, nil
+	case PGP:
+		if err := validatePGPFile(cipherText); err != nil {
+			return nil, fmt.Errorf("'%s' is not an OpenPGP encrypted file: %w", s.SopsFile, err)
+		}
+		return &secretFile{cipherText: cipherText, firstSecret: s}, nil
 	}
 
 	return &secretFile{
 		cipherText:  cipherText,
 		keys:        keys,
+		ini:         iniFile,
 		firstSecret: s,
 	}, nil
 }
@@ -555,8 +951,20 @@ func (app *appContext) validateSopsFile(s *secret, file *secretFile) error {
 			s.Name, s.SopsFile, s.Format,
 			file.firstSecret.Format, file.firstSecret.Name)
 	}
-	if app.checkMode != Manifest && (s.Format != Binary && s.Format != Dotenv && s.Format != Ini) && s.Key != "" {
-		_, err := recurseSecretKey(file.keys, s.Key)
+	if app.checkMode != Manifest && s.Key != "" {
+		var err error
+		switch s.Format {
+		case Yaml, JSON:
+			_, err = recurseSecretKey(file.keys, s.Key)
+		case Dotenv:
+			_, err = dotenvSecretKey(file.keys, s.Key)
+		case Ini:
+			_, err = iniSecretKey(file.ini, s.Key)
+		}
+		if err != nil && s.Generate != nil {
+			app.missingKeys = append(app.missingKeys, fmt.Sprintf("%s (key '%s' in %s)", s.Name, s.Key, s.SopsFile))
+			return nil
+		}
 		if err != nil {
 			return fmt.Errorf("secret %s in %s is not valid: %w", s.Name, s.SopsFile, err)
 		}
@@ -636,6 +1044,48 @@ func (app *appContext) validateSecret(secret *secret) error {
 		return fmt.Errorf("unsupported format %s for secret %s", secret.Format, secret.Name)
 	}
 
+	if secret.Delivery == KeyringDelivery {
+		if app.manifest.UserMode {
+			return fmt.Errorf("secret %s cannot be delivered by keyring in user mode", secret.Name)
+		}
+		secret.keyring = kernelKeyringName(app.manifest.SymlinkPath)
+	}
+
+	if secret.Delivery == BrokerDelivery && app.manifest.UserMode {
+		return fmt.Errorf("secret %s cannot be served by the broker in user mode", secret.Name)
+	}
+
+	if secret.Generate != nil {
+		if err := validateGenerateSpec(secret); err != nil {
+			return err
+		}
+	}
+
+	if secret.Name == GenerationMetadataFile {
+		return fmt.Errorf("secret name %s is reserved for the generation metadata", secret.Name)
+	}
+
+	for _, t := range secret.Transforms {
+		if err := validateTransform(t); err != nil {
+			return fmt.Errorf("secret %s is not valid: %w", secret.Name, err)
+		}
+	}
+
+	for _, h := range sortedHashes(secret) {
+		if err := app.validatePasswordHash(secret, h); err != nil {
+			return err
+		}
+	}
+
+	if secret.ValueFormat != nil {
+		if *secret.ValueFormat != Yaml && *secret.ValueFormat != JSON {
+			return fmt.Errorf("unsupported value format %s for secret %s, only yaml and json are supported", *secret.ValueFormat, secret.Name)
+		}
+		if secret.Format != Yaml && secret.Format != JSON {
+			return fmt.Errorf("secret %s sets a value format, but its format %s has no nested values", secret.Name, secret.Format)
+		}
+	}
+
 	file, ok := app.secretFiles[secret.SopsFile]
 	if !ok {
 		maybeFile, err := app.loadSopsFile(secret)
@@ -650,20 +1100,56 @@ func (app *appContext) validateSecret(secret *secret) error {
 	return app.validateSopsFile(secret, &file)
 }
 
-func renderTemplates(templates []template, secretByPlaceholder map[string]*secret) {
+// renderTemplates replaces the placeholders or executes the go templates of
+// all templates. A template that refers to a secret which was skipped keeps
+// its previously rendered file, or fails if there is none.
+func renderTemplates(logcfg loggingConfig, symlinkPath string, templates []template, secretByPlaceholder map[string]*secret, secrets []secret) error {
+	replacer := newPlaceholderReplacer(secretByPlaceholder)
 	for i := range templates {
 		template := &templates[i]
-		rendered := renderTemplate(&template.content, secretByPlaceholder)
-		template.value = []byte(rendered)
+		if template.goTemplate != nil {
+			rendered, err := executeGoTemplate(template.goTemplate, secrets, true)
+			if errors.Is(err, errSecretSkipped) {
+				err = carryForwardTemplate(logcfg, symlinkPath, template, err)
+			} else if err == nil {
+				template.value = rendered
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err := checkPlaceholders(template.content, secretByPlaceholder); err != nil {
+			return fmt.Errorf("cannot render template %s: %w", template.Name, err)
+		}
+		if err := checkSkippedPlaceholders(template.content, secretByPlaceholder); err != nil {
+			if err := carryForwardTemplate(logcfg, symlinkPath, template, err); err != nil {
+				return err
+			}
+			continue
+		}
+		template.value = []byte(replacer.Replace(template.content))
 	}
+	return nil
 }
 
-func renderTemplate(content *string, secretByPlaceholder map[string]*secret) string {
-	rendered := *content
-	for placeholder, secret := range secretByPlaceholder {
-		rendered = strings.ReplaceAll(rendered, placeholder, string(secret.value))
+// carryForwardTemplate keeps the rendered file of the previous generation for
+// a template that cannot be rendered because of cause.
+func carryForwardTemplate(logcfg loggingConfig, symlinkPath string, template *template, cause error) error {
+	previous, err := os.ReadFile(filepath.Join(symlinkPath, RenderedSubdir, template.Name))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("cannot render template %s and there is no previous version: %w", template.Name, cause)
 	}
-	return rendered
+	if err != nil {
+		return fmt.Errorf("cannot render template %s: %w (cannot read previous version: %s)", template.Name, cause, err)
+	}
+	template.value = previous
+	if logcfg.jsonOutput() {
+		logcfg.emit(event{Event: EventTemplateCarriedForward, Name: template.Name, Error: cause.Error()})
+	} else {
+		fmt.Fprintf(os.Stderr, "WARNING: keeping the previous version of template %s: %s\n", template.Name, cause)
+	}
+	return nil
 }
 
 func (app *appContext) validateTemplate(template *template) error {
@@ -713,6 +1199,21 @@ func (app *appContext) validateTemplate(template *template) error {
 
 	template.content = templateText
 
+	if template.Engine != GoTemplateEngine {
+		if err := checkPlaceholders(templateText, app.secretByPlaceholder); err != nil {
+			return fmt.Errorf("template %s is not valid: %w", template.Name, err)
+		}
+	} else {
+		tmpl, err := parseGoTemplate(template.Name, templateText)
+		if err != nil {
+			return err
+		}
+		if _, err := executeGoTemplate(tmpl, app.manifest.Secrets, false); err != nil {
+			return err
+		}
+		template.goTemplate = tmpl
+	}
+
 	return nil
 }
 
@@ -729,6 +1230,65 @@ func (app *appContext) validateManifest() error {
 		}
 	}
 
+	if m.DecryptionWorkers < 0 {
+		return fmt.Errorf("decryptionWorkers must not be negative, got %d", m.DecryptionWorkers)
+	}
+
+	if m.MaxGenerationAge != "" {
+		maxAge, err := time.ParseDuration(m.MaxGenerationAge)
+		if err != nil {
+			return fmt.Errorf("cannot parse maxGenerationAge: %w", err)
+		}
+		if maxAge <= 0 {
+			return fmt.Errorf("maxGenerationAge must be positive, got %s", m.MaxGenerationAge)
+		}
+		m.maxGenerationAge = maxAge
+	}
+
+	if m.UnitJobTimeout != "" {
+		timeout, err := time.ParseDuration(m.UnitJobTimeout)
+		if err != nil {
+			return fmt.Errorf("cannot parse unitJobTimeout: %w", err)
+		}
+		if timeout < 0 {
+			return fmt.Errorf("unitJobTimeout must not be negative, got %s", m.UnitJobTimeout)
+		}
+		m.unitJobTimeout = timeout
+	}
+
+	m.onChangeTimeout = DefaultOnChangeTimeout
+	if m.OnChangeTimeout != "" {
+		timeout, err := time.ParseDuration(m.OnChangeTimeout)
+		if err != nil {
+			return fmt.Errorf("cannot parse onChangeTimeout: %w", err)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("onChangeTimeout must be positive, got %s", m.OnChangeTimeout)
+		}
+		m.onChangeTimeout = timeout
+	}
+
+	if m.MaxSopsFileAge != "" {
+		maxAge, err := time.ParseDuration(m.MaxSopsFileAge)
+		if err != nil {
+			return fmt.Errorf("cannot parse maxSopsFileAge: %w", err)
+		}
+		if maxAge <= 0 {
+			return fmt.Errorf("maxSopsFileAge must be positive, got %s", m.MaxSopsFileAge)
+		}
+		m.maxSopsFileAge = maxAge
+	}
+
+	if m.MaxGenerationsBytes < 0 {
+		return fmt.Errorf("maxGenerationsBytes must not be negative, got %d", m.MaxGenerationsBytes)
+	}
+
+	for keyPath, passphrase := range m.SSHKeyPassphrases {
+		if (passphrase.File == "") == (passphrase.Credential == "") {
+			return fmt.Errorf("exactly one of file and credential must be set for the passphrase of ssh key '%s'", keyPath)
+		}
+	}
+
 	for i := range m.Secrets {
 		secret := &m.Secrets[i]
 		if err := app.validateSecret(secret); err != nil {
@@ -747,13 +1307,37 @@ func (app *appContext) validateManifest() error {
 		}
 	}
 
+	// Hashes are written next to the secrets in the same directory.
+	names := make(map[string]bool, len(m.Secrets))
+	for i := range m.Secrets {
+		names[m.Secrets[i].Name] = true
+	}
+	for i := range m.Secrets {
+		secret := &m.Secrets[i]
+		if len(secret.Hashes) > 0 && (secret.Delivery == KeyringDelivery || secret.Delivery == BrokerDelivery) {
+			return fmt.Errorf("secret %s is delivered by %s and cannot be hashed", secret.Name, secret.Delivery)
+		}
+		for _, h := range sortedHashes(secret) {
+			if names[h.Name] {
+				return fmt.Errorf("hash %s of secret %s has the same name as another secret or hash", h.Name, secret.Name)
+			}
+			names[h.Name] = true
+		}
+	}
+
 	for i := range m.Templates {
 		template := &m.Templates[i]
 		if err := app.validateTemplate(template); err != nil {
 			return err
 		}
 	}
-	return nil
+	if len(app.missingKeys) > 0 {
+		return fmt.Errorf("keys of generated secrets are missing, run `sops-install-secrets generate` to create them: %s", strings.Join(app.missingKeys, ", "))
+	}
+	if err := app.checkSopsFileAge(); err != nil {
+		return err
+	}
+	return app.validateUnits()
 }
 
 func atomicSymlink(oldname, newname string) error {
@@ -789,8 +1373,45 @@ func atomicSymlink(oldname, newname string) error {
 	return nil
 }
 
-func pruneGenerations(secretsMountPoint, secretsDir string, keepGenerations int) error {
-	if keepGenerations == 0 {
+// retentionPolicy decides which old generations are pruned, zero disables a
+// limit. If both keepGenerations and maxAge are set, a generation is only
+// pruned if it exceeds both: the newest keepGenerations generations and all
+// generations younger than maxAge are kept. maxTotalBytes then prunes the
+// oldest of the kept generations until they fit.
+type retentionPolicy struct {
+	keepGenerations int
+	maxAge          time.Duration
+	maxTotalBytes   int64
+}
+
+func (m *manifest) retentionPolicy() retentionPolicy {
+	return retentionPolicy{
+		keepGenerations: m.KeepGenerations,
+		maxAge:          m.maxGenerationAge,
+		maxTotalBytes:   m.MaxGenerationsBytes,
+	}
+}
+
+func generationSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func pruneGenerations(logcfg loggingConfig, secretsMountPoint, secretsDir string, policy retentionPolicy) error {
+	if policy == (retentionPolicy{}) {
 		return nil // Nothing to prune
 	}
 
@@ -800,40 +1421,116 @@ func pruneGenerations(secretsMountPoint, secretsDir string, keepGenerations int)
 		return fmt.Errorf("logic error, current generation is not numeric: %w", err)
 	}
 
-	// Read files in the mount directory
-	file, err := os.Open(secretsMountPoint)
+	generations, err := listGenerations(secretsMountPoint)
 	if err != nil {
-		return fmt.Errorf("cannot open %s: %w", secretsMountPoint, err)
+		return err
 	}
-	defer func() { _ = file.Close() }()
 
-	generations, err := file.Readdirnames(0)
-	if err != nil {
-		return fmt.Errorf("cannot read %s: %w", secretsMountPoint, err)
-	}
-	for _, generationName := range generations {
-		generationNum, err := strconv.Atoi(generationName)
-		// Not a number? Not relevant
-		if err != nil {
-			continue
-		}
+	now := time.Now()
+	prune := make(map[int]bool)
+	// Generations that are kept by the count and age limits, oldest first.
+	var remaining []int
+	for _, generationNum := range generations {
 		// Not strictly necessary but a good failsafe to
 		// make sure we don't prune the current generation
 		if generationNum == currentGeneration {
 			continue
 		}
-		if currentGeneration-keepGenerations >= generationNum {
-			err = os.RemoveAll(path.Join(secretsMountPoint, generationName))
+		expired := policy.keepGenerations > 0 && currentGeneration-policy.keepGenerations >= generationNum
+		if policy.maxAge > 0 && (expired || policy.keepGenerations == 0) {
+			created, err := generationTime(filepath.Join(secretsMountPoint, strconv.Itoa(generationNum)))
 			if err != nil {
 				return err
 			}
+			// Generations younger than maxAge are kept, even beyond
+			// keepGenerations.
+			expired = now.Sub(created) > policy.maxAge
+		}
+		if expired {
+			prune[generationNum] = true
+			continue
+		}
+		remaining = append(remaining, generationNum)
+	}
+
+	if policy.maxTotalBytes > 0 {
+		total, err := generationSize(secretsDir)
+		if err != nil {
+			return fmt.Errorf("cannot determine size of %s: %w", secretsDir, err)
+		}
+		sizes := make([]int64, len(remaining))
+		for i, generationNum := range remaining {
+			generationPath := filepath.Join(secretsMountPoint, strconv.Itoa(generationNum))
+			if sizes[i], err = generationSize(generationPath); err != nil {
+				return fmt.Errorf("cannot determine size of %s: %w", generationPath, err)
+			}
+			total += sizes[i]
+		}
+		for i, generationNum := range remaining {
+			if total <= policy.maxTotalBytes {
+				break
+			}
+			prune[generationNum] = true
+			total -= sizes[i]
 		}
 	}
 
+	for _, generationNum := range generations {
+		if !prune[generationNum] {
+			continue
+		}
+		generationPath := path.Join(secretsMountPoint, strconv.Itoa(generationNum))
+		err = os.RemoveAll(generationPath)
+		if err != nil {
+			return err
+		}
+		logcfg.emit(event{Event: EventGenerationPruned, Path: generationPath, Generation: generationNum})
+	}
+
 	return nil
 }
 
-func importSSHKeys(logcfg loggingConfig, keyPaths []string, gpgHome string) error {
+func readSSHKeyPassphrase(passphrases map[string]sshKeyPassphrase, keyPath string) ([]byte, error) {
+	source, ok := passphrases[keyPath]
+	if !ok {
+		return nil, nil
+	}
+	passphraseFile := source.File
+	if source.Credential != "" {
+		credentialsDir, ok := os.LookupEnv("CREDENTIALS_DIRECTORY")
+		if !ok {
+			return nil, fmt.Errorf("passphrase of ssh key '%s' is read from systemd credential '%s', but $CREDENTIALS_DIRECTORY is not set", keyPath, source.Credential)
+		}
+		passphraseFile = filepath.Join(credentialsDir, source.Credential)
+	}
+	passphrase, err := os.ReadFile(passphraseFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read passphrase of ssh key '%s': %w", keyPath, err)
+	}
+	passphrase = bytes.TrimSuffix(passphrase, []byte("\n"))
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("passphrase of ssh key '%s' in '%s' is empty", keyPath, passphraseFile)
+	}
+	return passphrase, nil
+}
+
+// sshKeyConversionError turns a failed conversion into an error if a
+// passphrase was configured, as the key is then expected to be usable.
+// Otherwise the key is skipped with a message on stderr, as before.
+func sshKeyConversionError(logcfg loggingConfig, keyPath string, passphrase []byte, err error) error {
+	if passphrase != nil {
+		return fmt.Errorf("cannot convert ssh key '%s': %w", keyPath, err)
+	}
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		logcfg.keySkipped(keyPath, "Cannot convert ssh key '%s': key is encrypted, but no passphrase is configured", keyPath)
+	} else {
+		logcfg.keySkipped(keyPath, "Cannot convert ssh key '%s': %s", keyPath, err)
+	}
+	return nil
+}
+
+func importSSHKeys(logcfg loggingConfig, keyPaths []string, passphrases map[string]sshKeyPassphrase, gpgHome string) error {
 	secringPath := filepath.Join(gpgHome, "secring.gpg")
 	pubringPath := filepath.Join(gpgHome, "pubring.gpg")
 
@@ -856,59 +1553,81 @@ func importSSHKeys(logcfg loggingConfig, keyPaths []string, gpgHome string) erro
 	for _, p := range keyPaths {
 		sshKey, err := os.ReadFile(p)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Cannot read ssh key '%s': %s\n", p, err)
+			logcfg.keySkipped(p, "Cannot read ssh key '%s': %s", p, err)
 			continue
 		}
-		gpgKey, err := sshkeys.SSHPrivateKeyToPGP(sshKey)
+		passphrase, err := readSSHKeyPassphrase(passphrases, p)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return err
+		}
+		gpgKey, err := sshkeys.SSHPrivateKeyToPGP(sshKey, passphrase)
+		if err != nil {
+			if err := sshKeyConversionError(logcfg, p, passphrase, err); err != nil {
+				return err
+			}
 			continue
 		}
 
 		if err := gpgKey.SerializePrivate(secring, nil); err != nil {
-			fmt.Fprintf(os.Stderr, "Cannot write secring: %s\n", err)
+			logcfg.keySkipped(p, "Cannot write secring: %s", err)
 			continue
 		}
 
 		if err := gpgKey.Serialize(pubring); err != nil {
-			fmt.Fprintf(os.Stderr, "Cannot write pubring: %s\n", err)
+			logcfg.keySkipped(p, "Cannot write pubring: %s", err)
 			continue
 		}
 
 		if logcfg.KeyImport {
-			fmt.Printf("%s: Imported %s as GPG key with fingerprint %s\n", path.Base(os.Args[0]), p, hex.EncodeToString(gpgKey.PrimaryKey.Fingerprint[:]))
+			fingerprint := hex.EncodeToString(gpgKey.PrimaryKey.Fingerprint[:])
+			if logcfg.jsonOutput() {
+				logcfg.emit(event{Event: EventKeyImported, Path: p, KeyType: "gpg", Fingerprint: fingerprint})
+			} else {
+				fmt.Printf("%s: Imported %s as GPG key with fingerprint %s\n", path.Base(os.Args[0]), p, fingerprint)
+			}
 		}
 	}
 
 	return nil
 }
 
-func importAgeSSHKeys(logcfg loggingConfig, keyPaths []string, ageFile os.File) {
+func importAgeSSHKeys(logcfg loggingConfig, keyPaths []string, passphrases map[string]sshKeyPassphrase, ageFile os.File) error {
 	for _, p := range keyPaths {
 		// Read the key
 		sshKey, err := os.ReadFile(p)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Cannot read ssh key '%s': %s\n", p, err)
+			logcfg.keySkipped(p, "Cannot read ssh key '%s': %s", p, err)
 			continue
 		}
+		passphrase, err := readSSHKeyPassphrase(passphrases, p)
+		if err != nil {
+			return err
+		}
 		// Convert the key to age
-		privKey, pubKey, err := agessh.SSHPrivateKeyToAge(sshKey, []byte{})
+		privKey, pubKey, err := agessh.SSHPrivateKeyToAge(sshKey, passphrase)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Cannot convert ssh key '%s': %s\n", p, err)
+			if err := sshKeyConversionError(logcfg, p, passphrase, err); err != nil {
+				return err
+			}
 			continue
 		}
 		// Append it to the file
 		_, err = ageFile.WriteString(*privKey + "\n")
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Cannot write key to age file: %s\n", err)
+			logcfg.keySkipped(p, "Cannot write key to age file: %s", err)
 			continue
 		}
 
 		if logcfg.KeyImport {
-			fmt.Fprintf(os.Stderr, "%s: Imported %s as age key with fingerprint %s\n", path.Base(os.Args[0]), p, *pubKey)
+			if logcfg.jsonOutput() {
+				logcfg.emit(event{Event: EventKeyImported, Path: p, KeyType: "age", Fingerprint: *pubKey})
+			} else {
+				fmt.Fprintf(os.Stderr, "%s: Imported %s as age key with fingerprint %s\n", path.Base(os.Args[0]), p, *pubKey)
+			}
 			continue
 		}
 	}
+	return nil
 }
 
 // Like filepath.Walk but symlink-aware.
@@ -940,224 +1659,282 @@ func symlinkWalk(filename string, linkDirname string, walkFn filepath.WalkFunc)
 	return filepath.Walk(filename, symWalkFunc)
 }
 
-func handleModifications(isDry bool, logcfg loggingConfig, symlinkPath string, secretDir string, secrets []secret, templates []template) error {
-	var restart []string
-	var reload []string
+// generationChanges lists the secrets and templates, by name, that differ
+// between two generations.
+type generationChanges struct {
+	newSecrets      map[string]bool
+	modifiedSecrets map[string]bool
+	removedSecrets  map[string]bool
+
+	newTemplates      map[string]bool
+	modifiedTemplates map[string]bool
+	removedTemplates  map[string]bool
+
+	// restartUnits and reloadUnits belong to the new and modified secrets
+	// and templates. They are only acted on once the new generation is in
+	// place, see restartChangedUnits and writeActivationLists.
+	restartUnits []string
+	reloadUnits  []string
+}
 
-	newSecrets := make(map[string]bool)
-	modifiedSecrets := make(map[string]bool)
-	removedSecrets := make(map[string]bool)
+// changedFile compares a file of the old generation with the new one.
+func changedFile(oldPath, newPath string) (isNew bool, isModified bool, err error) {
+	oldData, err := os.ReadFile(oldPath)
+	if err != nil {
+		// File did not exist before or the path changed from a file to a directory or vice versa
+		if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) || errors.Is(err, syscall.EISDIR) {
+			return true, false, nil
+		}
+		return false, false, err
+	}
 
-	newTemplates := make(map[string]bool)
-	modifiedTemplates := make(map[string]bool)
-	removedTemplates := make(map[string]bool)
+	newData, err := os.ReadFile(newPath)
+	if err != nil {
+		return false, false, err
+	}
+	return false, !bytes.Equal(oldData, newData), nil
+}
 
-	// When the symlink path does not exist yet, we are being run in stage-2-init.sh
-	// where switch-to-configuration is not run so the services would only be restarted
-	// the next time switch-to-configuration is run.
-	if _, err := os.Stat(symlinkPath); os.IsNotExist(err) {
-		return nil
+// compareGenerations finds new and modified secrets and templates in newDir
+// compared to oldDir. Removed ones are only looked up by findRemoved.
+func compareGenerations(oldDir, newDir string, secrets []secret, templates []template) (*generationChanges, error) {
+	changes := generationChanges{
+		newSecrets:        make(map[string]bool),
+		modifiedSecrets:   make(map[string]bool),
+		removedSecrets:    make(map[string]bool),
+		newTemplates:      make(map[string]bool),
+		modifiedTemplates: make(map[string]bool),
+		removedTemplates:  make(map[string]bool),
 	}
 
 	// Find modified/new secrets
 	for _, secret := range secrets {
-		oldPath := filepath.Join(symlinkPath, secret.Name)
-		newPath := filepath.Join(secretDir, secret.Name)
-
-		// Read the old file
-		oldData, err := os.ReadFile(oldPath)
-		if err != nil {
-			// File did not exist before or the path changed from a file to a directory or vice versa
-			if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) || errors.Is(err, syscall.EISDIR) {
-				restart = append(restart, secret.RestartUnits...)
-				reload = append(reload, secret.ReloadUnits...)
-				newSecrets[secret.Name] = true
-				continue
-			}
-			return err
+		var isNew, isModified bool
+		var err error
+		switch secret.Delivery {
+		case BrokerDelivery:
+			// The broker picks up new values when it is restarted.
+			continue
+		case KeyringDelivery:
+			isNew, isModified, err = changedKey(&secret)
+		default:
+			isNew, isModified, err = changedFile(filepath.Join(oldDir, secret.Name), filepath.Join(newDir, secret.Name))
 		}
-
-		// Read the new file
-		newData, err := os.ReadFile(newPath)
 		if err != nil {
-			return err
+			return nil, err
 		}
-
-		if !bytes.Equal(oldData, newData) {
-			restart = append(restart, secret.RestartUnits...)
-			reload = append(reload, secret.ReloadUnits...)
-			modifiedSecrets[secret.Name] = true
+		if isNew {
+			changes.newSecrets[secret.Name] = true
+		} else if isModified {
+			changes.modifiedSecrets[secret.Name] = true
 		}
 	}
 
 	// Find modified/new templates
 	for _, template := range templates {
-		oldPath := filepath.Join(symlinkPath, RenderedSubdir, template.Name)
-		newPath := filepath.Join(secretDir, RenderedSubdir, template.Name)
-
-		// Read the old file
-		oldData, err := os.ReadFile(oldPath)
+		oldPath := filepath.Join(oldDir, RenderedSubdir, template.Name)
+		newPath := filepath.Join(newDir, RenderedSubdir, template.Name)
+		isNew, isModified, err := changedFile(oldPath, newPath)
 		if err != nil {
-			// File did not exist before or the path changed from a file to a directory or vice versa
-			if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) || errors.Is(err, syscall.EISDIR) {
-				restart = append(restart, template.RestartUnits...)
-				reload = append(reload, template.ReloadUnits...)
-				newTemplates[template.Name] = true
-				continue
-			}
-			return err
+			return nil, err
 		}
-
-		// Read the new file
-		newData, err := os.ReadFile(newPath)
-		if err != nil {
-			return err
+		if isNew {
+			changes.newTemplates[template.Name] = true
+		} else if isModified {
+			changes.modifiedTemplates[template.Name] = true
 		}
+	}
+	return &changes, nil
+}
+
+func handleModifications(isDry bool, logcfg loggingConfig, symlinkPath string, secretDir string, secrets []secret, templates []template) (*generationChanges, error) {
+	var restart []string
+	var reload []string
+
+	// When the symlink path does not exist yet, we are being run in stage-2-init.sh
+	// where switch-to-configuration is not run so the services would only be restarted
+	// the next time switch-to-configuration is run.
+	if _, err := os.Stat(symlinkPath); os.IsNotExist(err) {
+		return nil, nil
+	}
 
-		if !bytes.Equal(oldData, newData) {
+	changes, err := compareGenerations(symlinkPath, secretDir, secrets, templates)
+	if err != nil {
+		return nil, err
+	}
+	for _, secret := range secrets {
+		if changes.newSecrets[secret.Name] || changes.modifiedSecrets[secret.Name] {
+			restart = append(restart, secret.RestartUnits...)
+			reload = append(reload, secret.ReloadUnits...)
+		}
+	}
+	for _, template := range templates {
+		if changes.newTemplates[template.Name] || changes.modifiedTemplates[template.Name] {
 			restart = append(restart, template.RestartUnits...)
 			reload = append(reload, template.ReloadUnits...)
-			modifiedTemplates[template.Name] = true
-		}
-	}
-
-	// Decide how to propagate restart/reload requests.
-	//
-	// When we run as a systemd service (useSystemdActivation = true), the
-	// unit is ordered Before=sysinit-reactivation.target, which
-	// switch-to-configuration restarts *after* it has already consumed
-	// /run/nixos/activation-{restart,reload}-list. Writing to those files
-	// from here therefore does nothing on the current switch and leaks
-	// into the next one. On top of that, NixOS 26.05 deprecates the
-	// activation-list mechanism entirely.
-	//
-	// The NixOS module sets SOPS_RESTART_UNITS_VIA_SYSTEMCTL=1 on the
-	// systemd unit so we know to call systemctl directly. We cannot rely
-	// on INVOCATION_ID for this: switch-to-configuration is almost always
-	// invoked from a process tree rooted in some unit (sshd, getty,
-	// systemd-run, ...), so the activation script inherits it too. For
-	// the legacy activation-script path, keep writing the list files so
-	// that switch-to-configuration picks them up as before.
-	if os.Getenv("SOPS_RESTART_UNITS_VIA_SYSTEMCTL") == "1" {
-		systemctl := func(verb string, units []string) error {
-			if len(units) == 0 {
-				return nil
-			}
-			// --no-block: we are ordered before sysinit-reactivation.target
-			// with DefaultDependencies=no. Blocking on a normal service
-			// (which has After=sysinit.target) would deadlock the
-			// transaction.
-			args := append([]string{"--no-block", verb}, units...)
-			cmd := exec.Command("systemctl", args...)
-			cmd.Stdout = os.Stderr
-			cmd.Stderr = os.Stderr
-			if err := cmd.Run(); err != nil {
-				return fmt.Errorf("error running 'systemctl %s': %w", strings.Join(args, " "), err)
-			}
-			return nil
 		}
-		if isDry {
-			for _, u := range restart {
+	}
+	changes.restartUnits = restart
+	changes.reloadUnits = reload
+
+	if len(restart) > 0 {
+		logcfg.emit(event{Event: EventUnitsRestarted, Units: restart, Dry: isDry})
+	}
+	if len(reload) > 0 {
+		logcfg.emit(event{Event: EventUnitsReloaded, Units: reload, Dry: isDry})
+	}
+
+	// Do not output changes if not requested
+	if !logcfg.SecretChanges {
+		return changes, nil
+	}
+
+	if err := changes.findRemoved(symlinkPath, secrets, templates); err != nil {
+		return nil, err
+	}
+	changes.output(logcfg, isDry)
+	return changes, nil
+}
+
+// restartViaSystemd reports whether units are restarted by asking systemd
+// directly instead of through switch-to-configuration.
+//
+// When we run as a systemd service (useSystemdActivation = true), the
+// unit is ordered Before=sysinit-reactivation.target, which
+// switch-to-configuration restarts *after* it has already consumed
+// /run/nixos/activation-{restart,reload}-list. Writing to those files
+// from here therefore does nothing on the current switch and leaks
+// into the next one. On top of that, NixOS 26.05 deprecates the
+// activation-list mechanism entirely.
+//
+// The NixOS module sets SOPS_RESTART_UNITS_VIA_SYSTEMCTL=1 on the
+// systemd unit so we know to ask systemd directly over D-Bus. We cannot
+// rely on INVOCATION_ID for this: switch-to-configuration is almost
+// always invoked from a process tree rooted in some unit (sshd, getty,
+// systemd-run, ...), so the activation script inherits it too. For
+// the legacy activation-script path, keep writing the list files so
+// that switch-to-configuration picks them up as before.
+func restartViaSystemd() bool {
+	return os.Getenv("SOPS_RESTART_UNITS_VIA_SYSTEMCTL") == "1"
+}
+
+// restartChangedUnits asks systemd over D-Bus to restart and reload the
+// units of changed secrets and templates, in user mode those of the user's
+// systemd instance. It must only be called after the secrets symlink points
+// to the new generation, otherwise the units could restart with the old
+// secrets. Jobs are waited for up to jobTimeout.
+func restartChangedUnits(isDry bool, logcfg loggingConfig, userMode bool, changes *generationChanges, jobTimeout time.Duration) error {
+	if changes == nil {
+		return nil
+	}
+	if isDry {
+		if !logcfg.jsonOutput() {
+			for _, u := range changes.restartUnits {
 				fmt.Fprintf(os.Stderr, "would restart %s\n", u)
 			}
-			for _, u := range reload {
+			for _, u := range changes.reloadUnits {
 				fmt.Fprintf(os.Stderr, "would reload %s\n", u)
 			}
-		} else {
-			// try-restart: only act on units that are already running.
-			// On first activation the unit starts fresh with the new
-			// secret anyway, so a no-op is correct.
-			if err := systemctl("try-restart", restart); err != nil {
+		}
+		return nil
+	}
+	return restartUnits(logcfg, userMode, changes.restartUnits, changes.reloadUnits, jobTimeout)
+}
+
+// writeActivationLists appends the units of changed secrets and templates
+// to the lists switch-to-configuration reads after the activation script.
+func writeActivationLists(isDry bool, changes *generationChanges) error {
+	if changes == nil {
+		return nil
+	}
+	writeLines := func(list []string, file string) error {
+		if len(list) != 0 {
+			if _, err := os.Stat(filepath.Dir(file)); err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
 				return err
 			}
-			if err := systemctl("try-reload-or-restart", reload); err != nil {
+			f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+			if err != nil {
 				return err
 			}
-		}
-	} else {
-		writeLines := func(list []string, file string) error {
-			if len(list) != 0 {
-				if _, err := os.Stat(filepath.Dir(file)); err != nil {
-					if os.IsNotExist(err) {
-						return nil
-					}
-					return err
-				}
-				f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
-				if err != nil {
+			defer func() { _ = f.Close() }()
+			for _, unit := range list {
+				if _, err = f.WriteString(unit + "\n"); err != nil {
 					return err
 				}
-				defer func() { _ = f.Close() }()
-				for _, unit := range list {
-					if _, err = f.WriteString(unit + "\n"); err != nil {
-						return err
-					}
-				}
 			}
-			return nil
 		}
-		var dryPrefix string
-		if isDry {
-			dryPrefix = "/run/nixos/dry-activation"
-		} else {
-			dryPrefix = "/run/nixos/activation"
-		}
-		if err := writeLines(restart, dryPrefix+"-restart-list"); err != nil {
-			return err
-		}
-		if err := writeLines(reload, dryPrefix+"-reload-list"); err != nil {
-			return err
-		}
-	}
-
-	// Do not output changes if not requested
-	if !logcfg.SecretChanges {
 		return nil
 	}
+	var dryPrefix string
+	if isDry {
+		dryPrefix = "/run/nixos/dry-activation"
+	} else {
+		dryPrefix = "/run/nixos/activation"
+	}
+	if err := writeLines(changes.restartUnits, dryPrefix+"-restart-list"); err != nil {
+		return err
+	}
+	return writeLines(changes.reloadUnits, dryPrefix+"-reload-list")
+}
 
-	// Find removed secrets/templates.
-	symlinkRenderedPath := filepath.Join(symlinkPath, RenderedSubdir)
-	err := symlinkWalk(symlinkPath, symlinkPath, func(path string, info os.FileInfo, err error) error {
+// findRemoved walks oldDir for secrets and templates that are not part of
+// the new generation anymore.
+func (c *generationChanges) findRemoved(oldDir string, secrets []secret, templates []template) error {
+	renderedPath := filepath.Join(oldDir, RenderedSubdir)
+	return symlinkWalk(oldDir, oldDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if info.IsDir() {
+		if info.IsDir() || path == filepath.Join(oldDir, GenerationMetadataFile) {
 			return nil
 		}
 
-		// If the path we're looking at isn't in `symlinkRenderedPath`, then
+		// If the path we're looking at isn't in `renderedPath`, then
 		// it's a secret.
-		rel, err := filepath.Rel(symlinkRenderedPath, path)
+		rel, err := filepath.Rel(renderedPath, path)
 		if err != nil {
 			return err
 		}
 		isSecret := strings.HasPrefix(rel, "..")
 
 		if isSecret {
-			path = strings.TrimPrefix(path, symlinkPath+string(os.PathSeparator))
+			path = strings.TrimPrefix(path, oldDir+string(os.PathSeparator))
 			for _, secret := range secrets {
 				if secret.Name == path {
 					return nil
 				}
 			}
-			removedSecrets[path] = true
+			c.removedSecrets[path] = true
 		} else {
-			path = strings.TrimPrefix(path, symlinkRenderedPath+string(os.PathSeparator))
+			path = strings.TrimPrefix(path, renderedPath+string(os.PathSeparator))
 			for _, template := range templates {
 				if template.Name == path {
 					return nil
 				}
 			}
-			removedTemplates[path] = true
+			c.removedTemplates[path] = true
 		}
 		return nil
 	})
-	if err != nil {
-		return err
-	}
+}
 
-	// Output new/modified/removed secrets/templates
-	outputChanged := func(noun string, changed map[string]bool, regularPrefix, dryPrefix string) {
+// output reports new/modified/removed secrets/templates
+func (c *generationChanges) output(logcfg loggingConfig, isDry bool) {
+	outputChanged := func(noun string, changed map[string]bool, regularPrefix, dryPrefix string, eventName string) {
+		if logcfg.jsonOutput() {
+			keys := make([]string, 0, len(changed))
+			for key := range changed {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				logcfg.emit(event{Event: eventName, Name: key, Dry: isDry})
+			}
+			return
+		}
 		if len(changed) > 0 {
 			s := ""
 			if len(changed) != 1 {
@@ -1179,14 +1956,12 @@ func handleModifications(isDry bool, logcfg loggingConfig, symlinkPath string, s
 			fmt.Println(strings.Join(keys, ", "))
 		}
 	}
-	outputChanged("secret", newSecrets, "adding", "would add")
-	outputChanged("secret", modifiedSecrets, "modifying", "would modify")
-	outputChanged("secret", removedSecrets, "removing", "would remove")
-	outputChanged("rendered secret", newTemplates, "adding", "would add")
-	outputChanged("rendered secret", modifiedTemplates, "modifying", "would modify")
-	outputChanged("rendered secret", removedTemplates, "removing", "would remove")
-
-	return nil
+	outputChanged("secret", c.newSecrets, "adding", "would add", EventSecretAdded)
+	outputChanged("secret", c.modifiedSecrets, "modifying", "would modify", EventSecretModified)
+	outputChanged("secret", c.removedSecrets, "removing", "would remove", EventSecretRemoved)
+	outputChanged("rendered secret", c.newTemplates, "adding", "would add", EventTemplateAdded)
+	outputChanged("rendered secret", c.modifiedTemplates, "modifying", "would modify", EventTemplateModified)
+	outputChanged("rendered secret", c.removedTemplates, "removing", "would remove", EventTemplateRemoved)
 }
 
 type keyring struct {
@@ -1198,15 +1973,15 @@ func (k *keyring) Remove() {
 	_ = os.Unsetenv("GNUPGHOME")
 }
 
-func setupGPGKeyring(logcfg loggingConfig, sshKeys []string, parentDir string) (*keyring, error) {
+func setupGPGKeyring(logcfg loggingConfig, sshKeys []string, passphrases map[string]sshKeyPassphrase, parentDir string) (*keyring, error) {
 	dir, err := os.MkdirTemp(parentDir, "gpg")
 	if err != nil {
 		return nil, fmt.Errorf("cannot create gpg home in '%s': %w", parentDir, err)
 	}
 	k := keyring{dir}
 
-	if err := importSSHKeys(logcfg, sshKeys, dir); err != nil {
-		err = os.RemoveAll(dir)
+	if err := importSSHKeys(logcfg, sshKeys, passphrases, dir); err != nil {
+		_ = os.RemoveAll(dir)
 		return nil, err
 	}
 	_ = os.Setenv("GNUPGHOME", dir)
@@ -1218,19 +1993,48 @@ func parseFlags(args []string) (*options, error) {
 	var opts options
 	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
 	fs.Usage = func() {
-		_, err := fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [OPTION] manifest.json\n", args[0])
+		_, err := fmt.Fprintf(flag.CommandLine.Output(), "Usage: %[1]s [OPTION] manifest.json\n"+
+			"       %[1]s rollback [OPTION] [GENERATION] manifest.json\n"+
+			"       %[1]s list-generations [OPTION] manifest.json\n"+
+			"       %[1]s diff-generations [OPTION] GENERATION GENERATION manifest.json\n"+
+			"       %[1]s serve [OPTION] manifest.json\n"+
+			"       %[1]s get [OPTION] SECRET\n"+
+			"       %[1]s generate [OPTION] manifest.json\n", args[0])
 		if err != nil {
 			return
 		}
 		fs.PrintDefaults()
 	}
+	flagArgs := args[1:]
+	if len(flagArgs) > 0 {
+		switch c := Command(flagArgs[0]); c {
+		case Rollback, ListGenerations, DiffGenerations, Serve, Get, Generate:
+			opts.command = c
+			flagArgs = flagArgs[1:]
+		}
+	}
 	var checkMode string
 	fs.StringVar(&checkMode, "check-mode", "off", `Validate configuration without installing it (possible values: "manifest","sopsfile","off")`)
 	fs.BoolVar(&opts.ignorePasswd, "ignore-passwd", false, `Don't look up anything in /etc/passwd. Causes everything to be owned by root:root or the user executing the tool in user mode`)
-	if err := fs.Parse(args[1:]); err != nil {
+	var output string
+	fs.StringVar(&output, "output", "text", `Output format (possible values: "text","json"). With "json", one event per line is written to stdout`)
+	fs.BoolVar(&opts.watch, "watch", false, `Keep running and install secrets again whenever a sops file or template file changes (Linux only)`)
+	fs.DurationVar(&opts.watchDebounce, "watch-debounce", DefaultWatchDebounce, `With -watch, wait until files did not change for this long before installing secrets`)
+	fs.StringVar(&opts.socket, "socket", DefaultBrokerSocket, `Socket of the broker for serve and get`)
+	fs.IntVar(&opts.fd, "fd", -1, `With get, write the secret to this file descriptor instead of stdout`)
+	fs.StringVar(&opts.sourceRoot, "source-root", ".", `With generate, directory that sops files in the Nix store were copied from`)
+	fs.StringVar(&opts.systemdUnits, "systemd-units", "", `With -check-mode, directory with the unit files of the system that is built to check restartUnits and reloadUnits against`)
+	if err := fs.Parse(flagArgs); err != nil {
 		return nil, err
 	}
 
+	switch OutputFormat(output) {
+	case TextOutput, JSONOutput:
+		opts.output = OutputFormat(output)
+	default:
+		return nil, fmt.Errorf("invalid value provided for -output flag: %s", output)
+	}
+
 	switch CheckMode(checkMode) {
 	case Manifest, SopsFile, Off:
 		opts.checkMode = CheckMode(checkMode)
@@ -1238,11 +2042,53 @@ func parseFlags(args []string) (*options, error) {
 		return nil, fmt.Errorf("invalid value provided for -check-mode flag: %s", opts.checkMode)
 	}
 
-	if fs.NArg() != 1 {
+	if opts.watch {
+		if opts.command != "" {
+			return nil, fmt.Errorf("-watch cannot be used with %s", opts.command)
+		}
+		if opts.checkMode != Off {
+			return nil, fmt.Errorf("-watch cannot be used with -check-mode=%s", opts.checkMode)
+		}
+		if opts.watchDebounce <= 0 {
+			return nil, fmt.Errorf("invalid value provided for -watch-debounce flag: %s", opts.watchDebounce)
+		}
+	}
+
+	if opts.systemdUnits != "" && opts.checkMode == Off {
+		return nil, fmt.Errorf("-systemd-units can only be used with -check-mode")
+	}
+
+	if opts.fd >= 0 && opts.command != Get {
+		return nil, fmt.Errorf("-fd can only be used with %s", Get)
+	}
+	if opts.command == Get {
+		if fs.NArg() != 1 {
+			flag.Usage()
+			return nil, flag.ErrHelp
+		}
+		opts.secretName = fs.Arg(0)
+		return &opts, nil
+	}
+
+	var minArgs, maxArgs int
+	switch opts.command {
+	case Rollback:
+		maxArgs = 1
+	case DiffGenerations:
+		minArgs, maxArgs = 2, 2
+	}
+	if fs.NArg() < minArgs+1 || fs.NArg() > maxArgs+1 {
 		flag.Usage()
 		return nil, flag.ErrHelp
 	}
-	opts.manifest = fs.Arg(0)
+	for _, arg := range fs.Args()[:fs.NArg()-1] {
+		generation, err := strconv.Atoi(arg)
+		if err != nil || generation <= 0 {
+			return nil, fmt.Errorf("invalid generation provided for %s: %s", opts.command, arg)
+		}
+		opts.generations = append(opts.generations, generation)
+	}
+	opts.manifest = fs.Arg(fs.NArg() - 1)
 	return &opts, nil
 }
 
@@ -1317,16 +2163,42 @@ func writeTemplates(targetDir string, templates []template, keysGID int, userMod
 	return nil
 }
 
-func installSecrets(args []string) error {
+func installSecrets(args []string) (err error) {
 	opts, err := parseFlags(args)
 	if err != nil {
 		return err
 	}
 
+	var events *json.Encoder
+	if opts.output == JSONOutput {
+		events = newEventEncoder(os.Stdout)
+		defer func() {
+			if err != nil {
+				_ = events.Encode(event{Event: EventError, Error: err.Error()})
+			}
+		}()
+	}
+
+	switch {
+	case opts.command == Get:
+		return getSecret(opts)
+	case opts.command == Generate:
+		return generateSecrets(opts, loggingConfig{events: events})
+	case opts.watch:
+		return watchSecrets(opts, events)
+	}
+	return install(opts, events)
+}
+
+// install runs once: it installs a new generation of secrets or runs one of
+// the generation commands. With serve, it decrypts the secrets and keeps
+// serving them.
+func install(opts *options, events *json.Encoder) (err error) {
 	manifest, err := readManifest(opts.manifest)
 	if err != nil {
 		return err
 	}
+	manifest.Logging.events = events
 
 	if manifest.UserMode {
 		var rundir string
@@ -1339,6 +2211,9 @@ func installSecrets(args []string) error {
 		var newSecrets []secret
 		for _, secret := range manifest.Secrets {
 			secret.Path = replaceRuntimeDir(secret.Path, rundir)
+			for _, h := range secret.Hashes {
+				h.Path = replaceRuntimeDir(h.Path, rundir)
+			}
 			newSecrets = append(newSecrets, secret)
 		}
 		manifest.Secrets = newSecrets
@@ -1350,10 +2225,19 @@ func installSecrets(args []string) error {
 		manifest.Templates = newTemplates
 	}
 
+	// Inspecting generations only needs the paths from the manifest.
+	switch opts.command {
+	case ListGenerations:
+		return printGenerations(manifest)
+	case DiffGenerations:
+		return diffGenerations(manifest, opts.generations[0], opts.generations[1])
+	}
+
 	app := appContext{
 		manifest:            *manifest,
 		checkMode:           opts.checkMode,
 		ignorePasswd:        opts.ignorePasswd,
+		systemdUnitsDir:     opts.systemdUnits,
 		secretFiles:         make(map[string]secretFile),
 		secretByPlaceholder: make(map[string]*secret),
 	}
@@ -1378,13 +2262,21 @@ func installSecrets(args []string) error {
 
 	isDry := os.Getenv("NIXOS_ACTION") == "dry-activate"
 
+	if opts.command == Rollback {
+		wanted := 0
+		if len(opts.generations) > 0 {
+			wanted = opts.generations[0]
+		}
+		return rollbackGeneration(isDry, &app.manifest, wanted)
+	}
+
 	if err = MountSecretFs(manifest.SecretsMountPoint, keysGID, manifest.UseTmpfs, manifest.UserMode); err != nil {
 		return fmt.Errorf("failed to mount filesystem for secrets: %w", err)
 	}
 
 	if len(manifest.SSHKeyPaths) != 0 {
 		var keyring *keyring
-		keyring, err = setupGPGKeyring(manifest.Logging, manifest.SSHKeyPaths, manifest.SecretsMountPoint)
+		keyring, err = setupGPGKeyring(manifest.Logging, manifest.SSHKeyPaths, manifest.SSHKeyPassphrases, manifest.SecretsMountPoint)
 		if err != nil {
 			return fmt.Errorf("error setting up gpg keyring: %w", err)
 		}
@@ -1420,7 +2312,9 @@ func installSecrets(args []string) error {
 
 		// Import SSH keys
 		if len(manifest.AgeSSHKeyPaths) != 0 {
-			importAgeSSHKeys(manifest.Logging, manifest.AgeSSHKeyPaths, *ageFile)
+			if err = importAgeSSHKeys(manifest.Logging, manifest.AgeSSHKeyPaths, manifest.SSHKeyPassphrases, *ageFile); err != nil {
+				return fmt.Errorf("error importing age ssh keys: %w", err)
+			}
 		}
 		// Import the keyfile
 		if manifest.AgeKeyFile != "" {
@@ -1438,18 +2332,43 @@ func installSecrets(args []string) error {
 		}
 	}
 
-	if err := decryptSecrets(manifest.Secrets); err != nil {
+	if opts.command == Serve {
+		return serve(manifest.Logging, opts.socket, brokerSecrets(manifest.Secrets), manifest.DecryptionWorkers)
+	}
+
+	// The broker decrypts the secrets it serves itself, they never become
+	// part of a generation.
+	secrets := withoutBrokerSecrets(manifest.Secrets)
+	secretByPlaceholder := make(map[string]*secret, len(secrets))
+	for i := range secrets {
+		if placeholder, ok := manifest.PlaceholderBySecretName[secrets[i].Name]; ok {
+			secretByPlaceholder[placeholder] = &secrets[i]
+		}
+	}
+	errs := decryptSecretsEach(secrets, manifest.DecryptionWorkers)
+	installedSecrets, err := carryForwardSecrets(manifest.Logging, manifest.DecryptionFailurePolicy, manifest.SymlinkPath, secrets, errs)
+	if err != nil {
 		return err
 	}
+	hashes, err := hashSecrets(manifest.SymlinkPath, installedSecrets)
+	if err != nil {
+		return err
+	}
+	installedSecrets = append(installedSecrets, hashes...)
 
 	// Now that the secrets are decrypted, we can render the templates.
-	renderTemplates(manifest.Templates, app.secretByPlaceholder)
+	if err := renderTemplates(manifest.Logging, manifest.SymlinkPath, manifest.Templates, secretByPlaceholder, secrets); err != nil {
+		return err
+	}
 
 	secretDir, err := prepareSecretsDir(manifest.SecretsMountPoint, manifest.SymlinkPath, keysGID, manifest.UserMode)
 	if err != nil {
 		return fmt.Errorf("failed to prepare new secrets directory: %w", err)
 	}
-	if err := writeSecrets(*secretDir, manifest.Secrets, keysGID, manifest.UserMode); err != nil {
+	if generation, err := strconv.Atoi(filepath.Base(*secretDir)); err == nil {
+		manifest.Logging.emit(event{Event: EventGenerationNew, Path: *secretDir, Generation: generation, Dry: isDry})
+	}
+	if err := writeSecrets(*secretDir, fileSecrets(installedSecrets), keysGID, manifest.UserMode); err != nil {
 		return fmt.Errorf("cannot write secrets: %w", err)
 	}
 
@@ -1457,24 +2376,70 @@ func installSecrets(args []string) error {
 		return fmt.Errorf("cannot render templates: %w", err)
 	}
 
-	if !manifest.UserMode {
-		if err := handleModifications(isDry, manifest.Logging, manifest.SymlinkPath, *secretDir, manifest.Secrets, manifest.Templates); err != nil {
+	if err := writeGenerationMetadata(*secretDir, opts.manifest, installedSecrets, manifest.UserMode); err != nil {
+		return fmt.Errorf("cannot write generation metadata: %w", err)
+	}
+
+	var changes *generationChanges
+	// In user mode, units are only restarted in watch mode. On activation,
+	// home-manager restarts the sops-nix service itself.
+	// switch-to-configuration does not run while watching, so units are
+	// always restarted over D-Bus then.
+	viaSystemd := opts.watch || restartViaSystemd()
+	if !manifest.UserMode || opts.watch {
+		changes, err = handleModifications(isDry, manifest.Logging, manifest.SymlinkPath, *secretDir, installedSecrets, manifest.Templates)
+		if err != nil {
 			return fmt.Errorf("cannot request units to restart: %w", err)
 		}
+		if !viaSystemd {
+			if err := writeActivationLists(isDry, changes); err != nil {
+				return fmt.Errorf("cannot request units to restart: %w", err)
+			}
+		}
 	}
+	hooks := changeHooks(changes, installedSecrets, manifest.Templates)
 	// No need to perform the actual symlinking
 	if isDry {
-		return nil
+		if viaSystemd {
+			if err := restartChangedUnits(isDry, manifest.Logging, manifest.UserMode, changes, 0); err != nil {
+				return err
+			}
+		}
+		return runHooks(isDry, manifest.Logging, hooks, app.manifest.onChangeTimeout)
 	}
 	if err := atomicSymlink(*secretDir, manifest.SymlinkPath); err != nil {
 		return fmt.Errorf("cannot update secrets symlink: %w", err)
 	}
-	if err := symlinkSecretsAndTemplates(manifest.SymlinkPath, manifest.Secrets, manifest.Templates, manifest.UserMode); err != nil {
+	if err := symlinkSecretsAndTemplates(manifest.SymlinkPath, fileSecrets(installedSecrets), manifest.Templates, manifest.UserMode); err != nil {
 		return fmt.Errorf("failed to prepare symlinks to secret store: %w", err)
 	}
-	if err := pruneGenerations(manifest.SecretsMountPoint, *secretDir, manifest.KeepGenerations); err != nil {
+	if !manifest.UserMode {
+		if err := updateKernelKeyring(manifest.Logging, kernelKeyringName(manifest.SymlinkPath), installedSecrets); err != nil {
+			return fmt.Errorf("cannot update kernel keyring: %w", err)
+		}
+	}
+	// Units are restarted once they can see the new secrets. During
+	// activation, sops-install-secrets.service is ordered before
+	// sysinit-reactivation.target and the jobs cannot run before we exit, so
+	// they are only waited for in watch mode.
+	var unitErr error
+	if viaSystemd {
+		var jobTimeout time.Duration
+		if opts.watch {
+			jobTimeout = app.manifest.unitJobTimeout
+		}
+		unitErr = restartChangedUnits(isDry, manifest.Logging, manifest.UserMode, changes, jobTimeout)
+	}
+	hookErr := runHooks(isDry, manifest.Logging, hooks, app.manifest.onChangeTimeout)
+	if err := pruneGenerations(manifest.Logging, manifest.SecretsMountPoint, *secretDir, app.manifest.retentionPolicy()); err != nil {
 		return fmt.Errorf("cannot prune old secrets generations: %w", err)
 	}
+	if unitErr != nil {
+		return fmt.Errorf("cannot restart units: %w", unitErr)
+	}
+	if hookErr != nil {
+		return fmt.Errorf("onChange commands failed: %w", hookErr)
+	}
 
 	return nil
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+type OutputFormat string
+
+const (
+	TextOutput OutputFormat = "text"
+	JSONOutput OutputFormat = "json"
+)
+
+// event is a single record written as one line of JSON with -output=json.
+// Secrets are identified by name, their values or hashes of them are never
+// emitted.
+type event struct {
+	Event       string   `json:"event"`
+	Name        string   `json:"name,omitempty"`
+	Path        string   `json:"path,omitempty"`
+	KeyType     string   `json:"keyType,omitempty"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	Units       []string `json:"units,omitempty"`
+	Peer        *peer    `json:"peer,omitempty"`
+	Action      string   `json:"action,omitempty"`
+	Result      string   `json:"result,omitempty"`
+	Generation  int      `json:"generation,omitempty"`
+	Current     bool     `json:"current,omitempty"`
+	Time        string   `json:"time,omitempty"`
+	Manifest    string   `json:"manifest,omitempty"`
+	Dry         bool     `json:"dry,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// Event names, keep them stable as external tooling depends on them.
+const (
+	EventKeyImported            = "keyImported"
+	EventKeySkipped             = "keySkipped"
+	EventSecretAdded            = "secretAdded"
+	EventSecretModified         = "secretModified"
+	EventSecretRemoved          = "secretRemoved"
+	EventSecretCarriedForward   = "secretCarriedForward"
+	EventSecretSkipped          = "secretSkipped"
+	EventKeyRevoked             = "keyRevoked"
+	EventTemplateAdded          = "templateAdded"
+	EventTemplateModified       = "templateModified"
+	EventTemplateRemoved        = "templateRemoved"
+	EventTemplateCarriedForward = "templateCarriedForward"
+	EventUnitsRestarted         = "unitsRestarted"
+	EventUnitsReloaded          = "unitsReloaded"
+	EventUnitsUnknown           = "unitsUnknown"
+	EventSopsFileExpired        = "sopsFileExpired"
+	EventUnitJob                = "unitJob"
+	EventOnChangeRun            = "onChangeRun"
+	EventFileChanged            = "fileChanged"
+	EventSecretRequested        = "secretRequested"
+	EventSecretGenerated        = "secretGenerated"
+	EventGenerationNew          = "generationCreated"
+	EventGenerationPruned       = "generationPruned"
+	EventGenerationRollback     = "generationRolledBack"
+	EventGenerationListed       = "generation"
+	EventError                  = "error"
+)
+
+func newEventEncoder(w io.Writer) *json.Encoder {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc
+}
+
+// jsonOutput reports whether events are emitted instead of human readable
+// messages.
+func (l loggingConfig) jsonOutput() bool {
+	return l.events != nil
+}
+
+func (l loggingConfig) emit(e event) {
+	if l.events == nil {
+		return
+	}
+	if err := l.events.Encode(e); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot write event: %s\n", err)
+	}
+}
+
+// keySkipped reports an ssh key that could not be imported.
+func (l loggingConfig) keySkipped(keyPath string, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if l.jsonOutput() {
+		l.emit(event{Event: EventKeySkipped, Path: keyPath, Error: msg})
+		return
+	}
+	fmt.Fprintln(os.Stderr, msg)
+}
@@ -0,0 +1,64 @@
+package passwordhash
+
+import (
+	"crypto/rand"
+	"strings"
+)
+
+// itoa64 is the alphabet of crypt(3) hashes.
+const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// encode64 encodes src in little-endian groups of 3 bytes, as used by
+// yescrypt.
+func encode64(src []byte) string {
+	var dst strings.Builder
+	for i := 0; i < len(src); {
+		var value, bits uint32
+		for bits < 24 && i < len(src) {
+			value |= uint32(src[i]) << bits
+			bits += 8
+			i++
+		}
+		for b := uint32(0); b < bits; b += 6 {
+			dst.WriteByte(itoa64[value&0x3f])
+			value >>= 6
+		}
+	}
+	return dst.String()
+}
+
+// decode64 is the inverse of encode64.
+func decode64(src string) ([]byte, error) {
+	var dst []byte
+	for len(src) > 0 {
+		var value, bits uint32
+		for len(src) > 0 && bits < 24 {
+			c := strings.IndexByte(itoa64, src[0])
+			if c < 0 {
+				return nil, errInvalidEncoding
+			}
+			src = src[1:]
+			value |= uint32(c) << bits
+			bits += 6
+		}
+		if bits < 12 {
+			return nil, errInvalidEncoding
+		}
+		for ; bits >= 8; bits -= 8 {
+			dst = append(dst, byte(value))
+			value >>= 8
+		}
+		if value != 0 {
+			return nil, errInvalidEncoding
+		}
+	}
+	return dst, nil
+}
@@ -0,0 +1,112 @@
+// Package passwordhash creates password hashes for /etc/shadow, htpasswd
+// files and web services.
+package passwordhash
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Algorithm string
+
+const (
+	SHA512Crypt Algorithm = "sha512-crypt"
+	Yescrypt    Algorithm = "yescrypt"
+	Bcrypt      Algorithm = "bcrypt"
+	Argon2id    Algorithm = "argon2id"
+)
+
+// Parameters of argon2id, the second recommendation of RFC 9106.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+)
+
+var argon2Prefix = fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$", argon2.Version, argon2Memory, argon2Time, argon2Threads)
+
+func argon2Hash(password, salt []byte) string {
+	key := argon2.IDKey(password, salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return argon2Prefix + base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(key)
+}
+
+// Hash hashes password with a new random salt.
+func Hash(algorithm Algorithm, password []byte) (string, error) {
+	switch algorithm {
+	case SHA512Crypt:
+		salt, err := newSHA512CryptSalt()
+		if err != nil {
+			return "", err
+		}
+		return sha512Crypt(password, salt), nil
+	case Yescrypt:
+		salt, err := NewYescryptSalt()
+		if err != nil {
+			return "", err
+		}
+		return yescryptHash(password, salt)
+	case Bcrypt:
+		hash, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+		return string(hash), err
+	case Argon2id:
+		salt, err := randomBytes(16)
+		if err != nil {
+			return "", err
+		}
+		return argon2Hash(password, salt), nil
+	}
+	return "", fmt.Errorf("unknown hash algorithm '%s'", algorithm)
+}
+
+// Verify reports whether hash is a hash of password created by Hash. Hashes
+// with other parameters than Hash uses are reported as not matching, so
+// that they are replaced.
+func Verify(algorithm Algorithm, hash string, password []byte) bool {
+	var computed string
+	switch algorithm {
+	case SHA512Crypt:
+		salt, ok := sha512CryptSalt(hash)
+		if !ok {
+			return false
+		}
+		computed = sha512Crypt(password, salt)
+	case Yescrypt:
+		salt, ok := yescryptSalt(hash)
+		if !ok {
+			return false
+		}
+		var err error
+		if computed, err = yescryptHash(password, salt); err != nil {
+			return false
+		}
+	case Bcrypt:
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil || cost != bcrypt.DefaultCost {
+			return false
+		}
+		return bcrypt.CompareHashAndPassword([]byte(hash), password) == nil
+	case Argon2id:
+		rest, ok := strings.CutPrefix(hash, argon2Prefix)
+		if !ok {
+			return false
+		}
+		encodedSalt, _, ok := strings.Cut(rest, "$")
+		if !ok {
+			return false
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(encodedSalt)
+		if err != nil {
+			return false
+		}
+		computed = argon2Hash(password, salt)
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
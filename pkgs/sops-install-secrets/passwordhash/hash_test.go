@@ -0,0 +1,117 @@
+package passwordhash
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hashes created with crypt(3) of libxcrypt.
+func TestKnownAnswers(t *testing.T) {
+	for _, tc := range []struct {
+		algorithm Algorithm
+		password  string
+		hash      string
+	}{
+		{SHA512Crypt, "password", "$6$saltsalt$qFmFH.bQmmtXzyBY0s9v7Oicd2z4XSIecDzlB5KiA2/jctKu9YterLp8wwnSq.qc.eoxqOmSuNp2xS0ktL3nh/"},
+		{SHA512Crypt, "Hello world!", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{Yescrypt, "password", "$y$j9T$F5Jx5fExrKuPp53xLKQ..1$tnSYvahCwPBHKZUspmcxMfb0.WiB9W.zEaKlOBL35rC"},
+		{Yescrypt, "correct horse battery staple", "$y$j9T$F5Jx5fExrKuPp53xLKQ..1$y8e1eitiNDaQsFFW6d.9KbSTlk5zV3R3coZQtfcNAO5"},
+		{Yescrypt, "", "$y$j9T$F5Jx5fExrKuPp53xLKQ..1$5P1uc1zvKhieqEtKttbwCQrTPXpY1cK9wEnTDKAqLD8"},
+	} {
+		var got string
+		switch tc.algorithm {
+		case SHA512Crypt:
+			salt, ok := sha512CryptSalt(tc.hash)
+			if !ok {
+				t.Fatalf("cannot parse salt of %s", tc.hash)
+			}
+			got = sha512Crypt([]byte(tc.password), salt)
+		case Yescrypt:
+			salt, ok := yescryptSalt(tc.hash)
+			if !ok {
+				t.Fatalf("cannot parse salt of %s", tc.hash)
+			}
+			var err error
+			if got, err = yescryptHash([]byte(tc.password), salt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got != tc.hash {
+			t.Errorf("%s of %q:\nexp: %s\ngot: %s", tc.algorithm, tc.password, tc.hash, got)
+		}
+		if !Verify(tc.algorithm, tc.hash, []byte(tc.password)) {
+			t.Errorf("%s of %q does not verify", tc.algorithm, tc.password)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		algorithm Algorithm
+		prefix    string
+	}{
+		{SHA512Crypt, "$6$"},
+		{Yescrypt, "$y$j9T$"},
+		{Bcrypt, "$2a$10$"},
+		{Argon2id, "$argon2id$v=19$m=65536,t=3,p=4$"},
+	} {
+		hash, err := Hash(tc.algorithm, []byte("pw"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(hash, tc.prefix) {
+			t.Errorf("%s: %s does not start with %s", tc.algorithm, hash, tc.prefix)
+		}
+		if !Verify(tc.algorithm, hash, []byte("pw")) {
+			t.Errorf("%s: %s does not verify", tc.algorithm, hash)
+		}
+		if Verify(tc.algorithm, hash, []byte("wp")) {
+			t.Errorf("%s: %s verifies with the wrong password", tc.algorithm, hash)
+		}
+		// Every hash gets a new salt.
+		other, err := Hash(tc.algorithm, []byte("pw"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other == hash {
+			t.Errorf("%s: hashing twice returned the same hash %s", tc.algorithm, hash)
+		}
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	lowCost, err := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha512, err := Hash(SHA512Crypt, []byte("pw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Apart from the first case, the passwords match.
+	for _, tc := range []struct {
+		name      string
+		algorithm Algorithm
+		hash      string
+		password  string
+	}{
+		{"wrong password", SHA512Crypt, "$6$saltsalt$qFmFH.bQmmtXzyBY0s9v7Oicd2z4XSIecDzlB5KiA2/jctKu9YterLp8wwnSq.qc.eoxqOmSuNp2xS0ktL3nh/", "pw"},
+		{"custom rounds", SHA512Crypt, "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.", "Hello world!"},
+		{"other algorithm", Yescrypt, sha512, "pw"},
+		{"truncated", Yescrypt, "$y$j9T$F5Jx5fExrKuPp53xLKQ..1", "password"},
+		{"other yescrypt parameters", Yescrypt, "$y$j75$F5Jx5fExrKuPp53xLKQ..1$tnSYvahCwPBHKZUspmcxMfb0.WiB9W.zEaKlOBL35rC", "password"},
+		{"other bcrypt cost", Bcrypt, string(lowCost), "pw"},
+		{"other argon2 parameters", Argon2id, "$argon2id$v=19$m=19456,t=2,p=1$c2FsdHNhbHQ$AAAA", "pw"},
+		{"invalid argon2 salt", Argon2id, argon2Prefix + "!!$AAAA", "pw"},
+		{"unknown algorithm", "md5-crypt", "$1$saltsalt$", "pw"},
+	} {
+		if Verify(tc.algorithm, tc.hash, []byte(tc.password)) {
+			t.Errorf("%s: %s verifies", tc.name, tc.hash)
+		}
+	}
+	if _, err := Hash("md5-crypt", []byte("pw")); err == nil {
+		t.Error("hashing with an unknown algorithm succeeded")
+	}
+}
@@ -0,0 +1,129 @@
+package passwordhash
+
+import (
+	"crypto/sha512"
+	"strings"
+)
+
+// SHA-512 based crypt(3) as specified by Ulrich Drepper, with the default
+// of 5000 rounds.
+const (
+	sha512CryptPrefix = "$6$"
+	sha512CryptRounds = 5000
+)
+
+// sha512CryptOrder is the order in which the bytes of the digest are
+// encoded, three at a time.
+var sha512CryptOrder = [...][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+	{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+	{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+	{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+	{62, 20, 41},
+}
+
+func sha512Crypt(password []byte, salt string) string {
+	s := []byte(salt)
+
+	b := sha512.New()
+	b.Write(password)
+	b.Write(s)
+	b.Write(password)
+	altDigest := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(password)
+	a.Write(s)
+	cnt := len(password)
+	for ; cnt > 64; cnt -= 64 {
+		a.Write(altDigest)
+	}
+	a.Write(altDigest[:cnt])
+	for cnt = len(password); cnt > 0; cnt >>= 1 {
+		if cnt&1 != 0 {
+			a.Write(altDigest)
+		} else {
+			a.Write(password)
+		}
+	}
+	digest := a.Sum(nil)
+
+	dp := sha512.New()
+	for range password {
+		dp.Write(password)
+	}
+	pSeq := repeatBytes(dp.Sum(nil), len(password))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(digest[0]); i++ {
+		ds.Write(s)
+	}
+	sSeq := repeatBytes(ds.Sum(nil), len(s))
+
+	for i := 0; i < sha512CryptRounds; i++ {
+		c := sha512.New()
+		if i&1 != 0 {
+			c.Write(pSeq)
+		} else {
+			c.Write(digest)
+		}
+		if i%3 != 0 {
+			c.Write(sSeq)
+		}
+		if i%7 != 0 {
+			c.Write(pSeq)
+		}
+		if i&1 != 0 {
+			c.Write(digest)
+		} else {
+			c.Write(pSeq)
+		}
+		digest = c.Sum(digest[:0])
+	}
+
+	var out strings.Builder
+	out.WriteString(sha512CryptPrefix + salt + "$")
+	encode := func(w uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(itoa64[w&0x3f])
+			w >>= 6
+		}
+	}
+	for _, o := range sha512CryptOrder {
+		encode(uint32(digest[o[0]])<<16|uint32(digest[o[1]])<<8|uint32(digest[o[2]]), 4)
+	}
+	encode(uint32(digest[63]), 2)
+	return out.String()
+}
+
+// repeatBytes repeats digest up to n bytes.
+func repeatBytes(digest []byte, n int) []byte {
+	seq := make([]byte, 0, n)
+	for len(seq) < n {
+		seq = append(seq, digest[:min(len(digest), n-len(seq))]...)
+	}
+	return seq
+}
+
+// newSHA512CryptSalt returns the maximum of 16 random salt characters.
+func newSHA512CryptSalt() (string, error) {
+	b, err := randomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	salt := make([]byte, len(b))
+	for i, c := range b {
+		salt[i] = itoa64[c&0x3f]
+	}
+	return string(salt), nil
+}
+
+// sha512CryptSalt returns the salt of a hash created by sha512Crypt.
+func sha512CryptSalt(hash string) (string, bool) {
+	rest, ok := strings.CutPrefix(hash, sha512CryptPrefix)
+	if !ok || strings.HasPrefix(rest, "rounds=") {
+		return "", false
+	}
+	salt, _, ok := strings.Cut(rest, "$")
+	return salt, ok
+}
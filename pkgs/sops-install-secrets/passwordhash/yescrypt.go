@@ -0,0 +1,296 @@
+package passwordhash
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"strings"
+)
+
+// yescrypt with the default parameters of libxcrypt: YESCRYPT_DEFAULTS
+// (rw, 6 rounds, gather 4, simple 2, 12 KiB S-boxes), N = 4096, r = 32,
+// p = 1 and no ROM. This is a port of the reference implementation that
+// only supports these flags.
+const (
+	yescryptPrefix = "$y$j9T$"
+	yescryptN      = 4096
+	yescryptR      = 32
+
+	pwxSimple = 2
+	pwxGather = 4
+	pwxRounds = 6
+	sWidth    = 8
+	pwxWords  = pwxGather * pwxSimple * 2
+	sWords    = 3 * (1 << sWidth) * pwxSimple * 2
+	sMask     = ((1 << sWidth) - 1) * pwxSimple * 8
+)
+
+// yescryptHash hashes password with the given salt, which is encoded with the
+// crypt alphabet, e.g. as generated by NewYescryptSalt.
+func yescryptHash(password []byte, salt string) (string, error) {
+	saltBytes, err := decode64(salt)
+	if err != nil {
+		return "", err
+	}
+	hash := yescryptKDF(password, saltBytes, yescryptN, yescryptR, false)
+	return yescryptPrefix + salt + "$" + encode64(hash), nil
+}
+
+// NewYescryptSalt returns 16 random bytes encoded with the crypt alphabet.
+func NewYescryptSalt() (string, error) {
+	salt, err := randomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	return encode64(salt), nil
+}
+
+// yescryptSalt returns the salt of a hash created by yescryptHash.
+func yescryptSalt(hash string) (string, bool) {
+	rest, ok := strings.CutPrefix(hash, yescryptPrefix)
+	if !ok {
+		return "", false
+	}
+	salt, _, ok := strings.Cut(rest, "$")
+	return salt, ok
+}
+
+func yescryptKDF(password, salt []byte, n uint64, r int, prehash bool) []byte {
+	// Large costs are preceded by a run with a 64th of N.
+	if !prehash && n >= 0x100 && n*uint64(r) >= 0x20000 {
+		password = yescryptKDF(password, salt, n>>6, r, true)
+	}
+
+	key := "yescrypt"
+	if prehash {
+		key = "yescrypt-prehash"
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(password)
+	passwd := mac.Sum(nil)
+
+	b, _ := pbkdf2.Key(sha256.New, string(passwd), salt, 1, 128*r)
+	copy(passwd, b[:32])
+	yescryptSmix(b, r, n, passwd)
+
+	dk, _ := pbkdf2.Key(sha256.New, string(passwd), b, 1, 32)
+	if prehash {
+		return dk
+	}
+	// ClientKey and StoredKey as in SCRAM.
+	mac = hmac.New(sha256.New, dk)
+	mac.Write([]byte("Client Key"))
+	storedKey := sha256.Sum256(mac.Sum(nil))
+	return storedKey[:]
+}
+
+type pwxformCtx struct {
+	s0, s1, s2 []uint32
+	w          int
+}
+
+func yescryptSmix(b []byte, r int, n uint64, passwd []byte) {
+	s := 32 * r
+	nloopRW := (n + 2) / 3
+	nloopRW = (nloopRW + 1) &^ 1
+
+	v := make([]uint32, uint64(s)*n)
+	xy := make([]uint32, 2*s)
+
+	sbox := make([]uint32, sWords)
+	smix1(b[:128], 1, sWords/32, false, sbox, xy, nil)
+	ctx := &pwxformCtx{
+		s2: sbox[:sWords/3],
+		s1: sbox[sWords/3 : 2*sWords/3],
+		s0: sbox[2*sWords/3:],
+	}
+	mac := hmac.New(sha256.New, b[128*r-64:128*r])
+	mac.Write(passwd)
+	copy(passwd, mac.Sum(nil))
+
+	smix1(b, r, n, true, v, xy, ctx)
+	smix2(b, r, p2floor(n), nloopRW, v, xy, ctx)
+}
+
+// loadBlocks decodes b into x, shuffling the words of every 64 byte block
+// the way the SIMD implementations store them.
+func loadBlocks(x []uint32, b []byte) {
+	for k := 0; k < len(x)/16; k++ {
+		for i := 0; i < 16; i++ {
+			x[k*16+i] = binary.LittleEndian.Uint32(b[(k*16+(i*5%16))*4:])
+		}
+	}
+}
+
+func storeBlocks(b []byte, x []uint32) {
+	for k := 0; k < len(x)/16; k++ {
+		for i := 0; i < 16; i++ {
+			binary.LittleEndian.PutUint32(b[(k*16+(i*5%16))*4:], x[k*16+i])
+		}
+	}
+}
+
+func smix1(b []byte, r int, n uint64, rw bool, v []uint32, xy []uint32, ctx *pwxformCtx) {
+	s := 32 * r
+	x := xy[:s]
+	y := xy[s : 2*s]
+	loadBlocks(x, b[:128*r])
+	for i := uint64(0); i < n; i++ {
+		copy(v[i*uint64(s):], x)
+		if rw && i > 1 {
+			j := wrap(integerify(x, r), i)
+			xorBlocks(x, v[j*uint64(s):(j+1)*uint64(s)])
+		}
+		if ctx != nil {
+			blockmixPwxform(x, ctx, r)
+		} else {
+			blockmixSalsa8(x, y, r)
+		}
+	}
+	storeBlocks(b[:128*r], x)
+}
+
+func smix2(b []byte, r int, n uint64, nloop uint64, v []uint32, xy []uint32, ctx *pwxformCtx) {
+	s := 32 * r
+	x := xy[:s]
+	loadBlocks(x, b[:128*r])
+	for i := uint64(0); i < nloop; i++ {
+		j := integerify(x, r) & (n - 1)
+		vj := v[j*uint64(s) : (j+1)*uint64(s)]
+		xorBlocks(x, vj)
+		copy(vj, x)
+		blockmixPwxform(x, ctx, r)
+	}
+	storeBlocks(b[:128*r], x)
+}
+
+func xorBlocks(dst, src []uint32) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+// integerify returns words 0 and 1 of the last 64 byte block, which are at
+// 0 and 13 after shuffling.
+func integerify(x []uint32, r int) uint64 {
+	last := x[(2*r-1)*16:]
+	return uint64(last[13])<<32 | uint64(last[0])
+}
+
+func p2floor(x uint64) uint64 {
+	return 1 << (63 - bits.LeadingZeros64(x))
+}
+
+func wrap(x, i uint64) uint64 {
+	n := p2floor(i)
+	return (x & (n - 1)) + (i - n)
+}
+
+func blockmixSalsa8(b, y []uint32, r int) {
+	var x [16]uint32
+	copy(x[:], b[(2*r-1)*16:])
+	for i := 0; i < 2*r; i++ {
+		xorBlocks(x[:], b[i*16:(i+1)*16])
+		salsa20(&x, 8)
+		copy(y[i*16:], x[:])
+	}
+	for i := 0; i < r; i++ {
+		copy(b[i*16:(i+1)*16], y[(2*i)*16:])
+		copy(b[(i+r)*16:(i+r+1)*16], y[(2*i+1)*16:])
+	}
+}
+
+func blockmixPwxform(b []uint32, ctx *pwxformCtx, r int) {
+	r1 := 128 * r / (pwxWords * 4)
+	var x [pwxWords]uint32
+	copy(x[:], b[(r1-1)*pwxWords:])
+	for i := 0; i < r1; i++ {
+		if r1 > 1 {
+			xorBlocks(x[:], b[i*pwxWords:(i+1)*pwxWords])
+		}
+		pwxform(&x, ctx)
+		copy(b[i*pwxWords:], x[:])
+	}
+	i := (r1 - 1) * pwxWords / 16
+	salsa20((*[16]uint32)(b[i*16:]), 2)
+	for i++; i < 2*r; i++ {
+		xorBlocks(b[i*16:(i+1)*16], b[(i-1)*16:i*16])
+		salsa20((*[16]uint32)(b[i*16:]), 2)
+	}
+}
+
+func pwxform(x *[pwxWords]uint32, ctx *pwxformCtx) {
+	s0, s1, s2 := ctx.s0, ctx.s1, ctx.s2
+	w := ctx.w
+	for i := 0; i < pwxRounds; i++ {
+		for j := 0; j < pwxGather; j++ {
+			lane := x[j*pwxSimple*2:]
+			p0 := s0[(lane[0]&sMask)/4:]
+			p1 := s1[(lane[1]&sMask)/4:]
+			for k := 0; k < pwxSimple; k++ {
+				v := uint64(lane[2*k+1]) * uint64(lane[2*k])
+				v += uint64(p0[2*k+1])<<32 | uint64(p0[2*k])
+				v ^= uint64(p1[2*k+1])<<32 | uint64(p1[2*k])
+				lane[2*k] = uint32(v)
+				lane[2*k+1] = uint32(v >> 32)
+				if i != 0 && i != pwxRounds-1 {
+					s2[2*w] = uint32(v)
+					s2[2*w+1] = uint32(v >> 32)
+					w++
+				}
+			}
+		}
+	}
+	ctx.s0, ctx.s1, ctx.s2 = s2, s0, s1
+	ctx.w = w & ((1<<sWidth)*pwxSimple - 1)
+}
+
+func salsa20(b *[16]uint32, rounds int) {
+	var x [16]uint32
+	for i := 0; i < 16; i++ {
+		x[i*5%16] = b[i]
+	}
+	for i := 0; i < rounds; i += 2 {
+		x[4] ^= bits.RotateLeft32(x[0]+x[12], 7)
+		x[8] ^= bits.RotateLeft32(x[4]+x[0], 9)
+		x[12] ^= bits.RotateLeft32(x[8]+x[4], 13)
+		x[0] ^= bits.RotateLeft32(x[12]+x[8], 18)
+		x[9] ^= bits.RotateLeft32(x[5]+x[1], 7)
+		x[13] ^= bits.RotateLeft32(x[9]+x[5], 9)
+		x[1] ^= bits.RotateLeft32(x[13]+x[9], 13)
+		x[5] ^= bits.RotateLeft32(x[1]+x[13], 18)
+		x[14] ^= bits.RotateLeft32(x[10]+x[6], 7)
+		x[2] ^= bits.RotateLeft32(x[14]+x[10], 9)
+		x[6] ^= bits.RotateLeft32(x[2]+x[14], 13)
+		x[10] ^= bits.RotateLeft32(x[6]+x[2], 18)
+		x[3] ^= bits.RotateLeft32(x[15]+x[11], 7)
+		x[7] ^= bits.RotateLeft32(x[3]+x[15], 9)
+		x[11] ^= bits.RotateLeft32(x[7]+x[3], 13)
+		x[15] ^= bits.RotateLeft32(x[11]+x[7], 18)
+
+		x[1] ^= bits.RotateLeft32(x[0]+x[3], 7)
+		x[2] ^= bits.RotateLeft32(x[1]+x[0], 9)
+		x[3] ^= bits.RotateLeft32(x[2]+x[1], 13)
+		x[0] ^= bits.RotateLeft32(x[3]+x[2], 18)
+		x[6] ^= bits.RotateLeft32(x[5]+x[4], 7)
+		x[7] ^= bits.RotateLeft32(x[6]+x[5], 9)
+		x[4] ^= bits.RotateLeft32(x[7]+x[6], 13)
+		x[5] ^= bits.RotateLeft32(x[4]+x[7], 18)
+		x[11] ^= bits.RotateLeft32(x[10]+x[9], 7)
+		x[8] ^= bits.RotateLeft32(x[11]+x[10], 9)
+		x[9] ^= bits.RotateLeft32(x[8]+x[11], 13)
+		x[10] ^= bits.RotateLeft32(x[9]+x[8], 18)
+		x[12] ^= bits.RotateLeft32(x[15]+x[14], 7)
+		x[13] ^= bits.RotateLeft32(x[12]+x[15], 9)
+		x[14] ^= bits.RotateLeft32(x[13]+x[12], 13)
+		x[15] ^= bits.RotateLeft32(x[14]+x[13], 18)
+	}
+	for i := 0; i < 16; i++ {
+		b[i] += x[i*5%16]
+	}
+}
+
+var errInvalidEncoding = errors.New("invalid encoding of salt")
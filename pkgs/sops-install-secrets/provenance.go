@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/aes"
+	"github.com/getsops/sops/v3/cmd/sops/common"
+	"github.com/getsops/sops/v3/cmd/sops/formats"
+	"github.com/getsops/sops/v3/config"
+	"github.com/getsops/sops/v3/keyservice"
+	"google.golang.org/grpc"
+)
+
+// version is set by the nix package via -ldflags.
+var version = "dev"
+
+// GenerationMetadataFile is written into every generation. It is skipped when
+// generations are compared.
+const GenerationMetadataFile = ".sops-nix-generation.json"
+
+type generationMetadata struct {
+	Generation int              `json:"generation"`
+	Time       time.Time        `json:"time"`
+	Version    string           `json:"version"`
+	Manifest   manifestMetadata `json:"manifest"`
+	Secrets    []secretMetadata `json:"secrets"`
+}
+
+type manifestMetadata struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+type secretMetadata struct {
+	Name     string     `json:"name"`
+	SopsFile string     `json:"sopsFile"`
+	Format   FormatType `json:"format"`
+	// SHA256 is the hash of the encrypted source file.
+	SHA256 string `json:"sha256"`
+	// KeyType is the type of the key that decrypted the source file, for
+	// example age or pgp. It is empty if it cannot be determined.
+	KeyType string `json:"keyType,omitempty"`
+	// CarriedForward is set if the secret could not be decrypted and the
+	// value of the previous generation was kept.
+	CarriedForward bool `json:"carriedForward,omitempty"`
+}
+
+// decryptSopsFile decrypts a sops file and reports the type of the master
+// key that unlocked the data key. The data key is only unlocked once, through
+// a key service that records which key succeeded. With several key groups,
+// sops combines their parts and there is no single key type to report.
+func decryptSopsFile(cipherText []byte, format FormatType) ([]byte, string, error) {
+	store := common.StoreForFormat(formats.FormatFromString(string(format)), config.NewStoresConfig())
+	tree, err := store.LoadEncryptedFile(cipherText)
+	if err != nil {
+		return nil, "", err
+	}
+	recorder := &keyTypeRecorder{KeyServiceClient: keyservice.NewLocalClient()}
+	if len(tree.Metadata.KeyGroups) == 1 {
+		recorder.group = tree.Metadata.KeyGroups[0]
+	}
+	// DecryptTree also verifies the MAC of the file.
+	if _, err := common.DecryptTree(common.DecryptTreeOpts{
+		Tree:        &tree,
+		KeyServices: []keyservice.KeyServiceClient{recorder},
+		Cipher:      aes.NewCipher(),
+	}); err != nil {
+		return nil, "", err
+	}
+	plain, err := store.EmitPlainFile(tree.Branches)
+	if err != nil {
+		return nil, "", err
+	}
+	return plain, recorder.keyType, nil
+}
+
+// keyTypeRecorder remembers the type of the master key whose encrypted data
+// key was successfully decrypted.
+type keyTypeRecorder struct {
+	keyservice.KeyServiceClient
+	group   sops.KeyGroup
+	keyType string
+}
+
+func (r *keyTypeRecorder) Decrypt(ctx context.Context, in *keyservice.DecryptRequest, opts ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	rsp, err := r.KeyServiceClient.Decrypt(ctx, in, opts...)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range r.group {
+		if bytes.Equal(key.EncryptedDataKey(), in.Ciphertext) {
+			r.keyType = key.TypeToIdentifier()
+			break
+		}
+	}
+	return rsp, nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeGenerationMetadata records where the secrets of a generation came
+// from. The file may reveal which keys a host has and is only readable by
+// root, or the user in user mode.
+func writeGenerationMetadata(secretDir string, manifestPath string, secrets []secret, userMode bool) error {
+	generation, err := strconv.Atoi(filepath.Base(secretDir))
+	if err != nil {
+		return fmt.Errorf("logic error, generation is not numeric: %w", err)
+	}
+	manifestContent, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return fmt.Errorf("cannot read manifest: %w", err)
+	}
+	metadata := generationMetadata{
+		Generation: generation,
+		Time:       time.Now().UTC(),
+		Version:    version,
+		Manifest: manifestMetadata{
+			Path:   manifestPath,
+			SHA256: sha256Hex(manifestContent),
+		},
+		Secrets: make([]secretMetadata, 0, len(secrets)),
+	}
+	for _, secret := range secrets {
+		metadata.Secrets = append(metadata.Secrets, secretMetadata{
+			Name:           secret.Name,
+			SopsFile:       secret.SopsFile,
+			Format:         secret.Format,
+			SHA256:         secret.sourceSHA256,
+			KeyType:        secret.keyType,
+			CarriedForward: secret.carriedForward,
+		})
+	}
+	content, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(secretDir, GenerationMetadataFile)
+	if err := os.WriteFile(path, append(content, '\n'), 0o400); err != nil {
+		return fmt.Errorf("cannot write %s: %w", path, err)
+	}
+	if !userMode {
+		if err := os.Chown(path, 0, 0); err != nil {
+			return fmt.Errorf("cannot change owner/group of '%s' to 0/0: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// readGenerationMetadata returns nil without an error for generations that
+// were created before metadata was recorded.
+func readGenerationMetadata(dir string) (*generationMetadata, error) {
+	content, err := os.ReadFile(filepath.Join(dir, GenerationMetadataFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var metadata generationMetadata
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		return nil, fmt.Errorf("cannot parse metadata of generation %s: %w", dir, err)
+	}
+	return &metadata, nil
+}
+
+// generationTime is the creation time from the metadata, or the modification
+// time of the generation directory for older generations.
+func generationTime(dir string) (time.Time, error) {
+	metadata, err := readGenerationMetadata(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if metadata != nil {
+		return metadata.Time, nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime().UTC(), nil
+}
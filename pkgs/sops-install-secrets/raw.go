@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	agearmor "filippo.io/age/armor"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgparmor "github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// Files with the age and pgp formats are not wrapped by sops. They are
+// decrypted as a whole with the same key material sops would use.
+
+func ageIdentities() ([]age.Identity, error) {
+	var identities []age.Identity
+	if key := os.Getenv("SOPS_AGE_KEY"); key != "" {
+		parsed, err := age.ParseIdentities(strings.NewReader(key))
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse SOPS_AGE_KEY: %w", err)
+		}
+		identities = append(identities, parsed...)
+	}
+	if keyFile := os.Getenv("SOPS_AGE_KEY_FILE"); keyFile != "" {
+		f, err := os.Open(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open age key file: %w", err)
+		}
+		defer func() { _ = f.Close() }()
+		parsed, err := age.ParseIdentities(f)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse age key file '%s': %w", keyFile, err)
+		}
+		identities = append(identities, parsed...)
+	}
+	if len(identities) == 0 {
+		return nil, errors.New("no age identities available")
+	}
+	return identities, nil
+}
+
+func ageReader(cipherText []byte) io.Reader {
+	if bytes.HasPrefix(bytes.TrimSpace(cipherText), []byte(agearmor.Header)) {
+		return agearmor.NewReader(bytes.NewReader(bytes.TrimSpace(cipherText)))
+	}
+	return bytes.NewReader(cipherText)
+}
+
+func validateAgeFile(cipherText []byte) error {
+	_, err := age.ExtractHeader(ageReader(cipherText))
+	return err
+}
+
+func decryptAgeFile(cipherText []byte) ([]byte, error) {
+	identities, err := ageIdentities()
+	if err != nil {
+		return nil, err
+	}
+	r, err := age.Decrypt(ageReader(cipherText), identities...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func pgpReader(cipherText []byte) (io.Reader, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(cipherText), []byte("-----BEGIN PGP MESSAGE-----")) {
+		return bytes.NewReader(cipherText), nil
+	}
+	block, err := pgparmor.Decode(bytes.NewReader(cipherText))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode armor: %w", err)
+	}
+	return block.Body, nil
+}
+
+func validatePGPFile(cipherText []byte) error {
+	r, err := pgpReader(cipherText)
+	if err != nil {
+		return err
+	}
+	p, err := packet.Read(r)
+	if err != nil {
+		return fmt.Errorf("cannot read OpenPGP packet: %w", err)
+	}
+	switch p.(type) {
+	case *packet.EncryptedKey, *packet.SymmetricKeyEncrypted:
+		return nil
+	default:
+		return fmt.Errorf("not an encrypted OpenPGP message, first packet is %T", p)
+	}
+}
+
+// decryptPGPFile mirrors sops: the secring.gpg in GNUPGHOME, which is where
+// setupGPGKeyring puts keys converted from ssh keys, is tried first and the
+// gpg binary is used as a fallback.
+func decryptPGPFile(cipherText []byte) ([]byte, error) {
+	plain, err := decryptWithOpenPGP(cipherText)
+	if err == nil {
+		return plain, nil
+	}
+	plain, gpgErr := decryptWithGnuPG(cipherText)
+	if gpgErr != nil {
+		return nil, fmt.Errorf("%w (secring: %s)", gpgErr, err)
+	}
+	return plain, nil
+}
+
+func decryptWithOpenPGP(cipherText []byte) ([]byte, error) {
+	gpgHome := os.Getenv("GNUPGHOME")
+	if gpgHome == "" {
+		return nil, errors.New("GNUPGHOME is not set")
+	}
+	f, err := os.Open(filepath.Join(gpgHome, "secring.gpg"))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	keyring, err := openpgp.ReadKeyRing(f)
+	if err != nil {
+		return nil, err
+	}
+	r, err := pgpReader(cipherText)
+	if err != nil {
+		return nil, err
+	}
+	md, err := openpgp.ReadMessage(r, keyring, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(md.UnverifiedBody)
+}
+
+func decryptWithGnuPG(cipherText []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("gpg", "--batch", "--quiet", "--decrypt")
+	cmd.Stdin = bytes.NewReader(cipherText)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("gpg failed: %s", strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
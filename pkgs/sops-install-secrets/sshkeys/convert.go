@@ -1,38 +1,89 @@
 package sshkeys
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rsa"
+	"crypto/sha512"
 	"fmt"
+	"math/big"
+	"math/bits"
 	"reflect"
 	"time"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/ecdh"
+	pgpecdsa "github.com/ProtonMail/go-crypto/openpgp/ecdsa"
+	"github.com/ProtonMail/go-crypto/openpgp/eddsa"
 	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/ssh"
 )
 
-func parsePrivateKey(sshPrivateKey []byte) (*rsa.PrivateKey, error) {
-	privateKey, err := ssh.ParseRawPrivateKey(sshPrivateKey)
+// Curve OIDs as used in OpenPGP key packets (RFC 6637, RFC 9580 section 9.2).
+var (
+	oidEd25519    = []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0xda, 0x47, 0x0f, 0x01}
+	oidCurve25519 = []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0x97, 0x55, 0x01, 0x05, 0x01}
+	oidP256       = []byte{0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}
+	oidP384       = []byte{0x2b, 0x81, 0x04, 0x00, 0x22}
+	oidP521       = []byte{0x2b, 0x81, 0x04, 0x00, 0x23}
+)
+
+// OpenPGP algorithm ids used in the ECDH KDF parameters.
+const (
+	kdfHashSHA256   = 8
+	kdfHashSHA384   = 9
+	kdfHashSHA512   = 10
+	kdfCipherAES128 = 7
+	kdfCipherAES256 = 9
+)
+
+func parsePrivateKey(sshPrivateKey []byte, passphrase []byte) (crypto.PrivateKey, error) {
+	var privateKey interface{}
+	var err error
+	if len(passphrase) > 0 {
+		privateKey, err = ssh.ParseRawPrivateKeyWithPassphrase(sshPrivateKey, passphrase)
+	} else {
+		privateKey, err = ssh.ParseRawPrivateKey(sshPrivateKey)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	rsaKey, ok := privateKey.(*rsa.PrivateKey)
-
-	if !ok {
-		return nil, fmt.Errorf("only RSA keys are supported right now, got: %s", reflect.TypeOf(privateKey))
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+		return key, nil
+	case *ed25519.PrivateKey:
+		return *key, nil
+	default:
+		return nil, fmt.Errorf("only RSA, ECDSA and Ed25519 keys are supported right now, got: %s", reflect.TypeOf(privateKey))
 	}
-
-	return rsaKey, nil
 }
 
-func SSHPrivateKeyToPGP(sshPrivateKey []byte) (*openpgp.Entity, error) {
-	key, err := parsePrivateKey(sshPrivateKey)
+// SSHPrivateKeyToPGP converts an ssh private key to an OpenPGP entity. If
+// passphrase is not empty, it is used to decrypt the ssh key.
+func SSHPrivateKeyToPGP(sshPrivateKey []byte, passphrase []byte) (*openpgp.Entity, error) {
+	key, err := parsePrivateKey(sshPrivateKey, passphrase)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse private ssh key: %w", err)
 	}
 
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return rsaToPGP(key)
+	case ed25519.PrivateKey:
+		return ed25519ToPGP(key)
+	case *ecdsa.PrivateKey:
+		return ecdsaToPGP(key)
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", reflect.TypeOf(key))
+	}
+}
+
+func rsaToPGP(key *rsa.PrivateKey) (*openpgp.Entity, error) {
 	// Let's make keys reproducible
 	timeNull := time.Unix(0, 0)
 
@@ -60,10 +111,205 @@ func SSHPrivateKeyToPGP(sshPrivateKey []byte) (*openpgp.Entity, error) {
 			IssuerKeyId:               &gpgKey.PrimaryKey.KeyId,
 		},
 	}
-	err = gpgKey.Identities[uid.Id].SelfSignature.SignUserId(uid.Id, gpgKey.PrimaryKey, gpgKey.PrivateKey, nil)
+	identity := gpgKey.Identities[uid.Id]
+	err := identity.SelfSignature.SignUserId(uid.Id, gpgKey.PrimaryKey, gpgKey.PrivateKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Only the signatures listed here are serialized.
+	identity.Signatures = []*packet.Signature{identity.SelfSignature}
+
+	return gpgKey, nil
+}
+
+// ed25519ToPGP builds an EdDSA primary key from the SSH key and adds a
+// Curve25519 encryption subkey derived from the same seed, the same way
+// ssh-to-age converts Ed25519 keys to X25519.
+func ed25519ToPGP(key ed25519.PrivateKey) (*openpgp.Entity, error) {
+	timeNull := time.Unix(0, 0)
+
+	pub, err := parseKeyPacket(packet.PubKeyAlgoEdDSA, oidEd25519,
+		append([]byte{0x40}, key.Public().(ed25519.PublicKey)...), nil)
+	if err != nil {
+		return nil, err
+	}
+	primary := packet.NewEdDSAPrivateKey(timeNull, &eddsa.PrivateKey{
+		PublicKey: *pub.PublicKey.(*eddsa.PublicKey),
+		D:         key.Seed(),
+	})
+
+	digest := sha512.Sum512(key.Seed())
+	scalar := digest[:curve25519.ScalarSize]
+	scalar[0] &= 248
+	scalar[31] &= 127
+	scalar[31] |= 64
+	point, err := curve25519.X25519(scalar, curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("cannot derive curve25519 key: %w", err)
+	}
+	subPub, err := parseKeyPacket(packet.PubKeyAlgoECDH, oidCurve25519,
+		append([]byte{0x40}, point...), []byte{0x03, 0x01, kdfHashSHA256, kdfCipherAES128})
+	if err != nil {
+		return nil, err
+	}
+	sub := packet.NewECDHPrivateKey(timeNull, &ecdh.PrivateKey{
+		PublicKey: *subPub.PublicKey.(*ecdh.PublicKey),
+		D:         scalar,
+	})
+
+	return ecEntity(primary, sub, crypto.SHA256)
+}
+
+// ecdsaToPGP builds an ECDSA primary key from the SSH key and an ECDH
+// encryption subkey on the same curve that reuses the private scalar, as
+// ECDSA keys cannot be used for encryption themselves.
+func ecdsaToPGP(key *ecdsa.PrivateKey) (*openpgp.Entity, error) {
+	timeNull := time.Unix(0, 0)
+
+	var oid []byte
+	var hash crypto.Hash
+	var kdf []byte
+	switch key.Curve {
+	case elliptic.P256():
+		oid, hash, kdf = oidP256, crypto.SHA256, []byte{0x03, 0x01, kdfHashSHA256, kdfCipherAES128}
+	case elliptic.P384():
+		oid, hash, kdf = oidP384, crypto.SHA384, []byte{0x03, 0x01, kdfHashSHA384, kdfCipherAES256}
+	case elliptic.P521():
+		oid, hash, kdf = oidP521, crypto.SHA512, []byte{0x03, 0x01, kdfHashSHA512, kdfCipherAES256}
+	default:
+		return nil, fmt.Errorf("unsupported ECDSA curve: %s", key.Curve.Params().Name)
+	}
+
+	ecdhKey, err := key.ECDH()
+	if err != nil {
+		return nil, fmt.Errorf("cannot convert ECDSA key: %w", err)
+	}
+	point := ecdhKey.PublicKey().Bytes()
+
+	pub, err := parseKeyPacket(packet.PubKeyAlgoECDSA, oid, point, nil)
+	if err != nil {
+		return nil, err
+	}
+	primary := packet.NewECDSAPrivateKey(timeNull, &pgpecdsa.PrivateKey{
+		PublicKey: *pub.PublicKey.(*pgpecdsa.PublicKey),
+		D:         new(big.Int).SetBytes(ecdhKey.Bytes()),
+	})
+
+	subPub, err := parseKeyPacket(packet.PubKeyAlgoECDH, oid, point, kdf)
+	if err != nil {
+		return nil, err
+	}
+	sub := packet.NewECDHPrivateKey(timeNull, &ecdh.PrivateKey{
+		PublicKey: *subPub.PublicKey.(*ecdh.PublicKey),
+		D:         ecdhKey.Bytes(),
+	})
+
+	return ecEntity(primary, sub, hash)
+}
+
+// parseKeyPacket serializes a v4 public key packet with a zero creation time
+// and parses it back. go-crypto only exposes the curve implementations through
+// its packet parser, so this is how we get hold of properly initialised
+// ecdsa/eddsa/ecdh public keys.
+func parseKeyPacket(algo packet.PublicKeyAlgorithm, oid, point, kdf []byte) (*packet.PublicKey, error) {
+	var body bytes.Buffer
+	body.Write([]byte{4, 0, 0, 0, 0, byte(algo), byte(len(oid))})
+	body.Write(oid)
+	bitLength := 8*(len(point)-1) + bits.Len8(point[0])
+	body.Write([]byte{byte(bitLength >> 8), byte(bitLength)})
+	body.Write(point)
+	body.Write(kdf)
+
+	// new format header for a public key packet (tag 6)
+	var pkt bytes.Buffer
+	pkt.WriteByte(0xc0 | 6)
+	if body.Len() < 192 {
+		pkt.WriteByte(byte(body.Len()))
+	} else {
+		l := body.Len() - 192
+		pkt.Write([]byte{byte(l>>8) + 192, byte(l)})
+	}
+	pkt.Write(body.Bytes())
+
+	p, err := packet.Read(&pkt)
+	if err != nil {
+		return nil, fmt.Errorf("cannot build %s public key: %w", algoName(algo), err)
+	}
+	pub, ok := p.(*packet.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("cannot build %s public key: unexpected packet %T", algoName(algo), p)
+	}
+	return pub, nil
+}
+
+func algoName(algo packet.PublicKeyAlgorithm) string {
+	switch algo {
+	case packet.PubKeyAlgoEdDSA:
+		return "EdDSA"
+	case packet.PubKeyAlgoECDSA:
+		return "ECDSA"
+	case packet.PubKeyAlgoECDH:
+		return "ECDH"
+	default:
+		return fmt.Sprintf("algorithm %d", algo)
+	}
+}
+
+// ecEntity assembles an entity from a signing-only primary key and an
+// encryption subkey. All signatures use the zero timestamp to keep the
+// resulting key reproducible.
+func ecEntity(primary, sub *packet.PrivateKey, hash crypto.Hash) (*openpgp.Entity, error) {
+	timeNull := time.Unix(0, 0)
+
+	gpgKey := &openpgp.Entity{
+		PrimaryKey: &primary.PublicKey,
+		PrivateKey: primary,
+		Identities: make(map[string]*openpgp.Identity),
+	}
+	uid := packet.NewUserId("root", "Imported from SSH", "root@localhost")
+	isPrimaryID := true
+	gpgKey.Identities[uid.Id] = &openpgp.Identity{
+		Name:   uid.Id,
+		UserId: uid,
+		SelfSignature: &packet.Signature{
+			CreationTime: timeNull,
+			SigType:      packet.SigTypePositiveCert,
+			PubKeyAlgo:   primary.PubKeyAlgo,
+			Hash:         hash,
+			IsPrimaryId:  &isPrimaryID,
+			FlagsValid:   true,
+			FlagSign:     true,
+			FlagCertify:  true,
+			IssuerKeyId:  &gpgKey.PrimaryKey.KeyId,
+		},
+	}
+	identity := gpgKey.Identities[uid.Id]
+	err := identity.SelfSignature.SignUserId(uid.Id, gpgKey.PrimaryKey, gpgKey.PrivateKey, nil)
 	if err != nil {
 		return nil, err
 	}
+	// Only the signatures listed here are serialized.
+	identity.Signatures = []*packet.Signature{identity.SelfSignature}
+
+	sub.IsSubkey = true
+	subkey := openpgp.Subkey{
+		PublicKey:  &sub.PublicKey,
+		PrivateKey: sub,
+		Sig: &packet.Signature{
+			CreationTime:              timeNull,
+			SigType:                   packet.SigTypeSubkeyBinding,
+			PubKeyAlgo:                primary.PubKeyAlgo,
+			Hash:                      hash,
+			FlagsValid:                true,
+			FlagEncryptStorage:        true,
+			FlagEncryptCommunications: true,
+			IssuerKeyId:               &gpgKey.PrimaryKey.KeyId,
+		},
+	}
+	if err := subkey.Sig.SignKey(subkey.PublicKey, gpgKey.PrivateKey, nil); err != nil {
+		return nil, err
+	}
+	gpgKey.Subkeys = append(gpgKey.Subkeys, subkey)
 
 	return gpgKey, nil
 }
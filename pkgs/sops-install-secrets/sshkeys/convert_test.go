@@ -0,0 +1,186 @@
+package sshkeys
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"golang.org/x/crypto/ssh"
+)
+
+func readAsset(t *testing.T, name string) []byte {
+	t.Helper()
+	assets := os.Getenv("TEST_ASSETS")
+	if assets == "" {
+		assets = filepath.Join("..", "test-assets")
+	}
+	content, err := os.ReadFile(filepath.Join(assets, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func ecdsaKey(t *testing.T, curve elliptic.Curve) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(block)
+}
+
+// roundTrip encrypts a message to gpgKey and decrypts it again. sops reads
+// the generated secring with go-crypto, so it is serialized and parsed back
+// first.
+func roundTrip(t *testing.T, gpgKey *openpgp.Entity) {
+	t.Helper()
+	var secring bytes.Buffer
+	if err := gpgKey.SerializePrivate(&secring, nil); err != nil {
+		t.Fatal(err)
+	}
+	ring, err := openpgp.ReadKeyRing(&secring)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cipherText bytes.Buffer
+	w, err := openpgp.Encrypt(&cipherText, ring, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("test_value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	md, err := openpgp.ReadMessage(&cipherText, ring, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plain bytes.Buffer
+	if _, err := plain.ReadFrom(md.UnverifiedBody); err != nil {
+		t.Fatal(err)
+	}
+	if plain.String() != "test_value" {
+		t.Errorf("decrypted %q", plain.String())
+	}
+}
+
+func TestSSHPrivateKeyToPGP(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		key         []byte
+		algorithm   packet.PublicKeyAlgorithm
+		curve       packet.Curve
+		subkeys     int
+		fingerprint string
+	}{
+		// matches the pgp recipient in test-assets/secrets.yaml
+		{"rsa", readAsset(t, "ssh-key"), packet.PubKeyAlgoRSA, "", 0, "2504791468b153b8a3963cc97ba53d1919c5dfd4"},
+		{"ed25519", readAsset(t, "ssh-ed25519-key"), packet.PubKeyAlgoEdDSA, packet.Curve25519, 1, "b7513f09aae35820a81e1ed7be895a6e9bc4863d"},
+		{"ecdsa P-256", ecdsaKey(t, elliptic.P256()), packet.PubKeyAlgoECDSA, packet.CurveNistP256, 1, ""},
+		{"ecdsa P-384", ecdsaKey(t, elliptic.P384()), packet.PubKeyAlgoECDSA, packet.CurveNistP384, 1, ""},
+		{"ecdsa P-521", ecdsaKey(t, elliptic.P521()), packet.PubKeyAlgoECDSA, packet.CurveNistP521, 1, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gpgKey, err := SSHPrivateKeyToPGP(tc.key, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gpgKey.PrimaryKey.PubKeyAlgo != tc.algorithm {
+				t.Errorf("primary key has algorithm %d, expected %d", gpgKey.PrimaryKey.PubKeyAlgo, tc.algorithm)
+			}
+			if tc.curve != "" {
+				curve, err := gpgKey.PrimaryKey.Curve()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if curve != tc.curve {
+					t.Errorf("primary key uses curve %s, expected %s", curve, tc.curve)
+				}
+			}
+			if len(gpgKey.Subkeys) != tc.subkeys {
+				t.Fatalf("got %d subkeys, expected %d", len(gpgKey.Subkeys), tc.subkeys)
+			}
+			for _, subkey := range gpgKey.Subkeys {
+				if subkey.PublicKey.PubKeyAlgo != packet.PubKeyAlgoECDH {
+					t.Errorf("subkey has algorithm %d, expected ECDH", subkey.PublicKey.PubKeyAlgo)
+				}
+			}
+			if tc.fingerprint != "" && hex.EncodeToString(gpgKey.PrimaryKey.Fingerprint) != tc.fingerprint {
+				t.Errorf("fingerprint is %x, expected %s", gpgKey.PrimaryKey.Fingerprint, tc.fingerprint)
+			}
+
+			// The conversion is reproducible.
+			again, err := SSHPrivateKeyToPGP(tc.key, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(gpgKey.PrimaryKey.Fingerprint, again.PrimaryKey.Fingerprint) {
+				t.Errorf("fingerprint changed from %x to %x", gpgKey.PrimaryKey.Fingerprint, again.PrimaryKey.Fingerprint)
+			}
+			for i := range gpgKey.Subkeys {
+				if !bytes.Equal(gpgKey.Subkeys[i].PublicKey.Fingerprint, again.Subkeys[i].PublicKey.Fingerprint) {
+					t.Errorf("fingerprint of subkey %d changed", i)
+				}
+			}
+
+			roundTrip(t, gpgKey)
+		})
+	}
+}
+
+func TestSSHPrivateKeyToPGPErrors(t *testing.T) {
+	rsaKey := readAsset(t, "ssh-key")
+	encrypted, err := ssh.ParseRawPrivateKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(encrypted, "", []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedKey := pem.EncodeToMemory(block)
+
+	for _, tc := range []struct {
+		name       string
+		key        []byte
+		passphrase []byte
+	}{
+		{"empty", nil, nil},
+		{"not a key", []byte("not a key"), nil},
+		{"public key", readAsset(t, "ssh-ed25519-key.pub"), nil},
+		{"truncated", rsaKey[:len(rsaKey)/2], nil},
+		{"corrupted", bytes.Replace(rsaKey, []byte("\n"), []byte("\n!"), 3), nil},
+		{"encrypted without passphrase", encryptedKey, nil},
+		{"wrong passphrase", encryptedKey, []byte("wrong")},
+	} {
+		_, err := SSHPrivateKeyToPGP(tc.key, tc.passphrase)
+		if err == nil {
+			t.Errorf("%s: conversion succeeded", tc.name)
+		} else if !strings.HasPrefix(err.Error(), "failed to parse private ssh key: ") {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+	}
+
+	// The passphrase is used if it is given.
+	if _, err := SSHPrivateKeyToPGP(encryptedKey, []byte("hunter2")); err != nil {
+		t.Errorf("cannot convert encrypted key: %v", err)
+	}
+}
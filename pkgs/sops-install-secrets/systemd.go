@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	systemdDest      = "org.freedesktop.systemd1"
+	systemdPath      = dbus.ObjectPath("/org/freedesktop/systemd1")
+	systemdInterface = "org.freedesktop.systemd1.Manager"
+)
+
+// jobResult is the outcome of a systemd job, as reported by the JobRemoved
+// signal. Result is one of done, canceled, timeout, failed, dependency or
+// skipped.
+type jobResult struct {
+	Job    string
+	Unit   string
+	Result string
+}
+
+// systemdManager is the part of the systemd manager API used to restart and
+// reload units. Tests replace it with a fake bus.
+type systemdManager interface {
+	// SystemState returns the state of the manager, for example starting
+	// while the system boots and running or degraded afterwards.
+	SystemState() (string, error)
+	// TryRestartUnit and ReloadOrTryRestartUnit enqueue a job and return its
+	// object path without waiting for it.
+	TryRestartUnit(unit string) (string, error)
+	ReloadOrTryRestartUnit(unit string) (string, error)
+	// JobRemoved delivers the results of all jobs that finished since the
+	// manager was connected.
+	JobRemoved() <-chan jobResult
+	Close() error
+}
+
+// connectSystemd is replaced in tests. In user mode, it connects to the
+// systemd user instance on the session bus.
+var connectSystemd = connectSystemdBus
+
+type dbusSystemdManager struct {
+	conn    *dbus.Conn
+	manager dbus.BusObject
+	removed chan jobResult
+}
+
+func connectSystemdBus(userMode bool) (systemdManager, error) {
+	connect := dbus.ConnectSystemBus
+	if userMode {
+		connect = dbus.ConnectSessionBus
+	}
+	conn, err := connect()
+	if err != nil {
+		return nil, err
+	}
+	m := &dbusSystemdManager{
+		conn:    conn,
+		manager: conn.Object(systemdDest, systemdPath),
+		removed: make(chan jobResult),
+	}
+	// Subscribe before any job is enqueued, so that no result is missed.
+	if err := conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(systemdPath),
+		dbus.WithMatchInterface(systemdInterface),
+		dbus.WithMatchMember("JobRemoved"),
+	); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("cannot subscribe to JobRemoved: %w", err)
+	}
+	if err := m.manager.Call(systemdInterface+".Subscribe", 0).Err; err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("cannot subscribe to systemd signals: %w", err)
+	}
+	signals := make(chan *dbus.Signal, 16)
+	conn.Signal(signals)
+	go m.forwardJobResults(signals)
+	return m, nil
+}
+
+// forwardJobResults queues results until they are read. godbus blocks on
+// full signal channels, which would also block the replies to our calls.
+func (m *dbusSystemdManager) forwardJobResults(signals <-chan *dbus.Signal) {
+	var queue []jobResult
+	for {
+		var out chan<- jobResult
+		var next jobResult
+		if len(queue) > 0 {
+			out = m.removed
+			next = queue[0]
+		}
+		select {
+		case signal, ok := <-signals:
+			if !ok {
+				return
+			}
+			if signal.Name != systemdInterface+".JobRemoved" || len(signal.Body) != 4 {
+				continue
+			}
+			job, _ := signal.Body[1].(dbus.ObjectPath)
+			unit, _ := signal.Body[2].(string)
+			result, _ := signal.Body[3].(string)
+			queue = append(queue, jobResult{Job: string(job), Unit: unit, Result: result})
+		case out <- next:
+			queue = queue[1:]
+		}
+	}
+}
+
+func (m *dbusSystemdManager) SystemState() (string, error) {
+	state, err := m.manager.GetProperty(systemdInterface + ".SystemState")
+	if err != nil {
+		return "", err
+	}
+	s, ok := state.Value().(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected type of SystemState: %s", state.Signature())
+	}
+	return s, nil
+}
+
+func (m *dbusSystemdManager) enqueue(method, unit string) (string, error) {
+	var job dbus.ObjectPath
+	if err := m.manager.Call(systemdInterface+"."+method, 0, unit, "replace").Store(&job); err != nil {
+		return "", err
+	}
+	return string(job), nil
+}
+
+func (m *dbusSystemdManager) TryRestartUnit(unit string) (string, error) {
+	return m.enqueue("TryRestartUnit", unit)
+}
+
+func (m *dbusSystemdManager) ReloadOrTryRestartUnit(unit string) (string, error) {
+	return m.enqueue("ReloadOrTryRestartUnit", unit)
+}
+
+func (m *dbusSystemdManager) JobRemoved() <-chan jobResult {
+	return m.removed
+}
+
+func (m *dbusSystemdManager) Close() error {
+	return m.conn.Close()
+}
+
+// JobQueued is reported for jobs that were not waited for or that did not
+// finish before the timeout.
+const JobQueued = "queued"
+
+type unitJob struct {
+	unit   string
+	action string
+	job    string
+	result string
+	err    error
+}
+
+// restartUnits asks systemd to restart and reload units. Jobs are only
+// waited for if jobTimeout is positive and the system is not booting, as
+// the jobs may be ordered after sops-install-secrets itself.
+func restartUnits(logcfg loggingConfig, userMode bool, restart []string, reload []string, jobTimeout time.Duration) error {
+	if len(restart) == 0 && len(reload) == 0 {
+		return nil
+	}
+	bus, err := connectSystemd(userMode)
+	if err != nil {
+		return fmt.Errorf("cannot connect to systemd: %w", err)
+	}
+	defer func() { _ = bus.Close() }()
+
+	wait := jobTimeout > 0
+	if wait {
+		state, err := bus.SystemState()
+		if err != nil {
+			return fmt.Errorf("cannot get state of systemd: %w", err)
+		}
+		if state == "initializing" || state == "starting" {
+			wait = false
+		}
+	}
+
+	var jobs []*unitJob
+	seen := make(map[string]bool)
+	enqueue := func(action string, units []string, method func(string) (string, error)) {
+		for _, unit := range units {
+			unit = unitName(unit)
+			if seen[action+" "+unit] {
+				continue
+			}
+			seen[action+" "+unit] = true
+			job := &unitJob{unit: unit, action: action, result: JobQueued}
+			job.job, job.err = method(unit)
+			jobs = append(jobs, job)
+		}
+	}
+	// try-restart: only act on units that are already running. On first
+	// activation the unit starts fresh with the new secret anyway, so a
+	// no-op is correct.
+	enqueue("restart", restart, bus.TryRestartUnit)
+	enqueue("reload", reload, bus.ReloadOrTryRestartUnit)
+
+	if wait {
+		waitForJobs(bus, jobs, jobTimeout)
+	}
+
+	var errs []error
+	for _, job := range jobs {
+		if job.err != nil {
+			errs = append(errs, fmt.Errorf("cannot %s %s: %w", job.action, job.unit, job.err))
+		}
+		reportUnitJob(logcfg, job)
+	}
+	return errors.Join(errs...)
+}
+
+func waitForJobs(bus systemdManager, jobs []*unitJob, timeout time.Duration) {
+	pending := make(map[string]*unitJob)
+	for _, job := range jobs {
+		if job.err == nil {
+			pending[job.job] = job
+		}
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for len(pending) > 0 {
+		select {
+		case removed, ok := <-bus.JobRemoved():
+			if !ok {
+				return
+			}
+			if job, ok := pending[removed.Job]; ok {
+				job.result = removed.Result
+				delete(pending, removed.Job)
+			}
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+func reportUnitJob(logcfg loggingConfig, job *unitJob) {
+	if logcfg.jsonOutput() {
+		e := event{Event: EventUnitJob, Name: job.unit, Action: job.action, Result: job.result}
+		if job.err != nil {
+			e.Result = ""
+			e.Error = job.err.Error()
+		}
+		logcfg.emit(e)
+		return
+	}
+	switch {
+	case job.err != nil:
+		// Returned as an error by restartUnits.
+	case job.result == "done" || job.result == JobQueued || job.result == "skipped":
+		if logcfg.SecretChanges {
+			fmt.Printf("%s %s: %s\n", job.action, job.unit, job.result)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "warning: %s of %s finished with result %s\n", job.action, job.unit, job.result)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	gotemplate "text/template"
+)
+
+// placeholderPattern matches the placeholders generated by the Nix module.
+// Keep this in sync with `modules/sops/templates/default.nix`.
+var placeholderPattern = regexp.MustCompile(`<SOPS:[0-9a-f]{64}:PLACEHOLDER>`)
+
+// newPlaceholderReplacer substitutes all placeholders in a single pass over
+// the template, so placeholders that are part of a secret value are never
+// replaced themselves. At the same position, the longest placeholder wins.
+func newPlaceholderReplacer(secretByPlaceholder map[string]*secret) *strings.Replacer {
+	placeholders := make([]string, 0, len(secretByPlaceholder))
+	for placeholder := range secretByPlaceholder {
+		if placeholder != "" {
+			placeholders = append(placeholders, placeholder)
+		}
+	}
+	sort.Slice(placeholders, func(i, j int) bool {
+		if len(placeholders[i]) != len(placeholders[j]) {
+			return len(placeholders[i]) > len(placeholders[j])
+		}
+		return placeholders[i] < placeholders[j]
+	})
+	oldnew := make([]string, 0, 2*len(placeholders))
+	for _, placeholder := range placeholders {
+		oldnew = append(oldnew, placeholder, string(secretByPlaceholder[placeholder].value))
+	}
+	return strings.NewReplacer(oldnew...)
+}
+
+// checkPlaceholders rejects placeholders of secrets that are not part of the
+// manifest, which would otherwise end up in the rendered file verbatim.
+func checkPlaceholders(content string, secretByPlaceholder map[string]*secret) error {
+	for _, token := range placeholderPattern.FindAllString(content, -1) {
+		secret, ok := secretByPlaceholder[token]
+		if !ok {
+			return fmt.Errorf("placeholder %s does not belong to any secret in the manifest", token)
+		}
+		if err := checkTemplateDelivery(secret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTemplateDelivery rejects secrets that are never written to disk, a
+// rendered template would expose their value in a file.
+func checkTemplateDelivery(secret *secret) error {
+	if secret.Delivery == KeyringDelivery || secret.Delivery == BrokerDelivery {
+		return fmt.Errorf("secret '%s' is delivered by %s and cannot be used in templates", secret.Name, secret.Delivery)
+	}
+	return nil
+}
+
+// errSecretSkipped is returned for templates that refer to a secret which
+// could not be decrypted and was not installed.
+var errSecretSkipped = errors.New("was not installed because it cannot be decrypted")
+
+// checkSkippedPlaceholders rejects placeholders of secrets that were skipped,
+// which would otherwise be rendered as an empty string.
+func checkSkippedPlaceholders(content string, secretByPlaceholder map[string]*secret) error {
+	var skipped []string
+	for placeholder, secret := range secretByPlaceholder {
+		if secret.skipped && placeholder != "" && strings.Contains(content, placeholder) {
+			skipped = append(skipped, secret.Name)
+		}
+	}
+	if len(skipped) == 0 {
+		return nil
+	}
+	sort.Strings(skipped)
+	return fmt.Errorf("secret '%s' %w", strings.Join(skipped, "', '"), errSecretSkipped)
+}
+
+type TemplateEngine string
+
+const (
+	// PlaceholderEngine replaces the placeholders from config.sops.placeholder.
+	PlaceholderEngine TemplateEngine = "placeholder"
+	// GoTemplateEngine renders templates with text/template, secrets are
+	// looked up by name with {{ secret "name" }}.
+	GoTemplateEngine TemplateEngine = "go-template"
+)
+
+func (e *TemplateEngine) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	switch t := TemplateEngine(s); t {
+	case "":
+		*e = PlaceholderEngine
+	case PlaceholderEngine, GoTemplateEngine:
+		*e = t
+	default:
+		return fmt.Errorf("unknown template engine '%s'", s)
+	}
+	return nil
+}
+
+// goTemplateFuncs are the functions available in go-template templates. The
+// secret function is replaced in executeGoTemplate.
+func goTemplateFuncs() gotemplate.FuncMap {
+	return gotemplate.FuncMap{
+		"secret": func(name string) (string, error) {
+			return "", fmt.Errorf("secret '%s' is not available", name)
+		},
+		"b64enc": func(s string) string {
+			return base64.StdEncoding.EncodeToString([]byte(s))
+		},
+		"json": func(v interface{}) (string, error) {
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			enc.SetEscapeHTML(false)
+			if err := enc.Encode(v); err != nil {
+				return "", err
+			}
+			return strings.TrimSuffix(buf.String(), "\n"), nil
+		},
+		"shellQuote": func(s string) string {
+			return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+		},
+		"urlquery": url.QueryEscape,
+		"indent": func(spaces int, s string) string {
+			pad := strings.Repeat(" ", spaces)
+			return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+		},
+		"sha256": func(s string) string {
+			sum := sha256.Sum256([]byte(s))
+			return hex.EncodeToString(sum[:])
+		},
+	}
+}
+
+func parseGoTemplate(name, text string) (*gotemplate.Template, error) {
+	tmpl, err := gotemplate.New(name).Funcs(goTemplateFuncs()).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse template %s: %w", name, err)
+	}
+	return tmpl, nil
+}
+
+// executeGoTemplate renders tmpl. Without values, every secret renders as an
+// empty string, which is used to check that all referenced secrets exist.
+func executeGoTemplate(tmpl *gotemplate.Template, secrets []secret, withValues bool) ([]byte, error) {
+	lookupSecret := func(name string) (string, error) {
+		for i := range secrets {
+			if secrets[i].Name == name {
+				if err := checkTemplateDelivery(&secrets[i]); err != nil {
+					return "", err
+				}
+				if !withValues {
+					return "", nil
+				}
+				if secrets[i].skipped {
+					return "", fmt.Errorf("secret '%s' %w", name, errSecretSkipped)
+				}
+				return string(secrets[i].value), nil
+			}
+		}
+		return "", fmt.Errorf("secret '%s' is not defined", name)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Funcs(gotemplate.FuncMap{"secret": lookupSecret}).Execute(&buf, nil); err != nil {
+		return nil, fmt.Errorf("cannot render template %s: %w", tmpl.Name(), err)
+	}
+	return buf.Bytes(), nil
+}
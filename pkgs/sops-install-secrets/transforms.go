@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+type TransformType string
+
+const (
+	Base64DecodeTransform TransformType = "base64-decode"
+	Base64EncodeTransform TransformType = "base64-encode"
+	HexDecodeTransform    TransformType = "hex-decode"
+	HexEncodeTransform    TransformType = "hex-encode"
+	// TrimTransform removes leading and trailing whitespace.
+	TrimTransform TransformType = "trim"
+	// TrailingNewlineTransform appends a newline unless there is one.
+	TrailingNewlineTransform TransformType = "trailing-newline"
+	GunzipTransform          TransformType = "gunzip"
+)
+
+func validateTransform(t TransformType) error {
+	switch t {
+	case Base64DecodeTransform, Base64EncodeTransform, HexDecodeTransform, HexEncodeTransform,
+		TrimTransform, TrailingNewlineTransform, GunzipTransform:
+		return nil
+	}
+	return fmt.Errorf("unknown transform '%s'", t)
+}
+
+// applyTransforms applies transforms to value in order. value may be shared
+// with other secrets of the same file and is never modified.
+func applyTransforms(value []byte, transforms []TransformType) ([]byte, error) {
+	for _, t := range transforms {
+		var err error
+		switch t {
+		case Base64DecodeTransform:
+			value, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(value)))
+		case Base64EncodeTransform:
+			value = []byte(base64.StdEncoding.EncodeToString(value))
+		case HexDecodeTransform:
+			value, err = hex.DecodeString(string(bytes.TrimSpace(value)))
+		case HexEncodeTransform:
+			value = []byte(hex.EncodeToString(value))
+		case TrimTransform:
+			value = bytes.TrimSpace(value)
+		case TrailingNewlineTransform:
+			if !bytes.HasSuffix(value, []byte("\n")) {
+				value = append(value[:len(value):len(value)], '\n')
+			}
+		case GunzipTransform:
+			value, err = gunzip(value)
+		default:
+			err = fmt.Errorf("unknown transform '%s'", t)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot apply transform %s: %w", t, err)
+		}
+	}
+	return value, nil
+}
+
+func gunzip(value []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+type UnknownUnitsPolicy string
+
+const (
+	IgnoreUnknownUnits UnknownUnitsPolicy = "ignore"
+	WarnUnknownUnits   UnknownUnitsPolicy = "warn"
+	RejectUnknownUnits UnknownUnitsPolicy = "error"
+)
+
+func (p *UnknownUnitsPolicy) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	switch t := UnknownUnitsPolicy(s); t {
+	case "":
+		*p = IgnoreUnknownUnits
+	case IgnoreUnknownUnits, WarnUnknownUnits, RejectUnknownUnits:
+		*p = t
+	default:
+		return fmt.Errorf("unknown policy for unknown units '%s'", s)
+	}
+	return nil
+}
+
+var unitTypes = map[string]bool{
+	"service": true, "socket": true, "device": true, "mount": true,
+	"automount": true, "swap": true, "target": true, "path": true,
+	"timer": true, "slice": true, "scope": true,
+}
+
+// unitName returns the full name of unit. Like systemctl, names without a
+// unit type refer to services.
+func unitName(unit string) string {
+	if dot := strings.LastIndex(unit, "."); dot == -1 || !unitTypes[unit[dot+1:]] {
+		return unit + ".service"
+	}
+	return unit
+}
+
+// unitKnown reports whether unit is in known. Instances of template units
+// are known if the template is.
+func unitKnown(known map[string]bool, unit string) bool {
+	unit = unitName(unit)
+	if known[unit] {
+		return true
+	}
+	prefix, rest, isInstance := strings.Cut(unit, "@")
+	if !isInstance {
+		return false
+	}
+	dot := strings.LastIndex(rest, ".")
+	if dot == -1 {
+		return false
+	}
+	return known[prefix+"@"+rest[dot:]]
+}
+
+// validateUnits checks that the units restarted or reloaded for secrets and
+// templates exist in the system that is built. Its unit directory is passed
+// with -systemd-units by a check of the NixOS configuration, next to the
+// units defined in the configuration that are listed in the manifest. The
+// manifest itself cannot refer to the unit directory, because the units
+// refer to the manifest. Without it, e.g. during activation, units are not
+// checked.
+func (app *appContext) validateUnits() error {
+	m := &app.manifest
+	// Manifests without unknownUnits, e.g. from nix-darwin, are not checked.
+	if app.systemdUnitsDir == "" || m.UnknownUnits == "" || m.UnknownUnits == IgnoreUnknownUnits || m.UserMode {
+		return nil
+	}
+	reject := m.UnknownUnits == RejectUnknownUnits
+
+	known := make(map[string]bool, len(m.SystemdUnits))
+	for _, unit := range m.SystemdUnits {
+		known[unit] = true
+	}
+	entries, err := os.ReadDir(app.systemdUnitsDir)
+	if err != nil {
+		return fmt.Errorf("cannot read units of the system: %w", err)
+	}
+	for _, entry := range entries {
+		known[entry.Name()] = true
+	}
+	// Nothing to validate against.
+	if len(known) == 0 {
+		return nil
+	}
+
+	check := func(kind, name string, unitLists ...[]string) error {
+		var unknown []string
+		for _, units := range unitLists {
+			for _, unit := range units {
+				if !unitKnown(known, unit) {
+					unknown = append(unknown, unit)
+				}
+			}
+		}
+		if len(unknown) == 0 {
+			return nil
+		}
+		sort.Strings(unknown)
+		msg := fmt.Sprintf("%s %s refers to unknown units: %s", kind, name, strings.Join(unknown, ", "))
+		if reject {
+			return fmt.Errorf("%s", msg)
+		}
+		if m.Logging.jsonOutput() {
+			m.Logging.emit(event{Event: EventUnitsUnknown, Name: name, Units: unknown})
+		} else {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", msg)
+		}
+		return nil
+	}
+	for _, secret := range m.Secrets {
+		if err := check("secret", secret.Name, secret.RestartUnits, secret.ReloadUnits); err != nil {
+			return err
+		}
+	}
+	for _, template := range m.Templates {
+		if err := check("template", template.Name, template.RestartUnits, template.ReloadUnits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
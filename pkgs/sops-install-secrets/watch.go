@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultWatchDebounce is the default of -watch-debounce.
+const DefaultWatchDebounce = 2 * time.Second
+
+// watchedPaths returns the sops files and template files of the manifest.
+// Files in the Nix store never change and are not watched.
+func watchedPaths(m *manifest) []string {
+	seen := make(map[string]bool)
+	var paths []string
+	add := func(path string) {
+		if path == "" || strings.HasPrefix(path, "/nix/store/") || seen[path] {
+			return
+		}
+		seen[path] = true
+		paths = append(paths, path)
+	}
+	for _, secret := range m.Secrets {
+		add(secret.SopsFile)
+	}
+	for _, template := range m.Templates {
+		add(template.File)
+	}
+	return paths
+}
+
+// watchSecrets installs the secrets and then installs a new generation
+// whenever a watched file changes. systemd is only notified that the service
+// is ready once the first installation succeeded, otherwise watching fails.
+// Later failures are reported and the previous generation stays in place
+// until the next change.
+func watchSecrets(opts *options, events *json.Encoder) error {
+	m, err := readManifest(opts.manifest)
+	if err != nil {
+		return err
+	}
+	paths := watchedPaths(m)
+	if len(paths) == 0 {
+		return fmt.Errorf("nothing to watch, all sops files and template files are in the Nix store")
+	}
+	// Start watching before the first installation, so that no change is
+	// missed in between.
+	changed, err := watchFiles(paths)
+	if err != nil {
+		return err
+	}
+	// There is no switch-to-configuration that picks up the restart list,
+	// units are restarted directly.
+	if err := os.Setenv("SOPS_RESTART_UNITS_VIA_SYSTEMCTL", "1"); err != nil {
+		return err
+	}
+
+	if err := install(opts, events); err != nil {
+		return err
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot notify systemd: %s\n", err)
+	}
+
+	logcfg := loggingConfig{events: events}
+	return debounce(changed, opts.watchDebounce, func(paths []string) {
+		for _, path := range paths {
+			logcfg.emit(event{Event: EventFileChanged, Path: path})
+			if !logcfg.jsonOutput() {
+				fmt.Printf("%s changed\n", path)
+			}
+		}
+		if err := install(opts, events); err != nil {
+			if logcfg.jsonOutput() {
+				logcfg.emit(event{Event: EventError, Error: err.Error()})
+			} else {
+				fmt.Fprintf(os.Stderr, "cannot install secrets: %s\n", err)
+			}
+		}
+	})
+}
+
+// debounce calls f with the changed paths once no change was seen for
+// delay. It only returns when changed is closed.
+func debounce(changed <-chan string, delay time.Duration, f func([]string)) error {
+	var pending []string
+	seen := make(map[string]bool)
+	timer := time.NewTimer(delay)
+	timer.Stop()
+	for {
+		select {
+		case path, ok := <-changed:
+			if !ok {
+				timer.Stop()
+				return fmt.Errorf("stopped watching files")
+			}
+			if !seen[path] {
+				seen[path] = true
+				pending = append(pending, path)
+			}
+			timer.Reset(delay)
+		case <-timer.C:
+			f(pending)
+			pending = nil
+			seen = make(map[string]bool)
+		}
+	}
+}
+
+// sdNotify reports the state to systemd for services with Type=notify.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Abstract sockets are passed with a leading @.
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	_, err = conn.Write([]byte(state))
+	return err
+}